@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// process groups are not available, only the command itself is killed when
+// the command is cancelled
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/meilisearch/meilisearch-go"
+	"gopkg.in/yaml.v3"
+)
+
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+// commands other than run work on the state saved in DATA_PATH. Commands
+// that change videos.json should not be used while run is running since
+// run saves its own copy of the videos when it stops
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"run":          {"run [-u] [-w]", "download, transcribe and index the videos of all sources", run},
+		"status":       {"status", "show the number of videos in each status", commandStatus},
+		"list":         {"list [--status <status>] [--source <url>]", "list videos", commandList},
+		"show":         {"show <id>", "show the saved data and files of a video", commandShow},
+		"retry":        {"retry <id>... | --all-failed", "clear the failures of videos and resume them from the last step that completed", commandRetry},
+		"reset":        {"reset <id>... [--to <status>]", "set the status of videos, pending by default", commandReset},
+		"skip":         {"skip <id>...", "skip videos so that they are never downloaded", commandSkip},
+		"priority":     {"priority <id> <n>", "set the priority of a video, videos with a higher priority are downloaded and transcribed first", commandPriority},
+		"add":          {"add <id|url|path>...", "add videos, playlists or local files to the queue without filters", commandAdd},
+		"process":      {"process [--force] <id|url|path>...", "download, transcribe and index only the given videos right away", commandProcess},
+		"reindex":      {"reindex [<id>...]", "upload indexed videos to the search index again, all of them by default", commandReindex},
+		"retranscribe": {"retranscribe [--model <path>] [--source <url>] [--from-model <name>] --all | <id>...", "transcribe videos again, for example with a better model, keeping the current transcripts as previous versions", commandRetranscribe},
+		"remove":       {"remove <id>...", "remove videos from videos.json and the search index", commandRemove},
+		"search":       {"search [--channel <name|url>] [--after <date>] [--before <date>] [--min-duration <duration>] [--max-duration <duration>] [--limit <n>] [--offset <n>] [--semantic <ratio>] [--json] <query>", "search the transcripts and show the moments of each video where the query is said", commandSearch},
+		"serve":        {"serve", "serve the search as a json api at /search on SEARCH_ADDR", commandServe},
+		"config":       {"config print", "print the config with env variables and -set flags applied and secrets redacted", commandConfig},
+		"help":         {"help", "show this help", commandHelp},
+	}
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		commandHelp(nil)
+		return fmt.Errorf("unknown command %s", name)
+	}
+	return cmd.run(args)
+}
+
+func commandHelp(args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	fmt.Println("Usage: yt-meilisearch-helper <command> [-config <path>] [-set <key>=<value>]... [arguments]")
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", commands[name].usage, commands[name].description)
+	}
+	return w.Flush()
+}
+
+// parseArgs parses flags that come before or after the other arguments and
+// returns the other arguments
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func loadState(configFlags *configFlags) (*Config, *SafeVideoDataCollection, error) {
+	config, err := configFlags.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = config.ValidateState()
+	if err != nil {
+		return nil, nil, err
+	}
+	videoDataCollection, err := loadProgress(config.DataPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, &SafeVideoDataCollection{videosDataAndStatus: videoDataCollection}, nil
+}
+
+// savedVideo is an entry of videos.json along with the id it is saved
+// under. The id is kept apart from the entry since entries whose details
+// could not be fetched have no id, which is how they are found to fetch
+// their details again
+type savedVideo struct {
+	id    string
+	entry VideoData
+}
+
+// readVideos returns the videos with the given ids or an error naming the
+// first id that is not in videos.json
+func readVideos(safeVideoDataCollection *SafeVideoDataCollection, ids []string) ([]savedVideo, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("no video id given")
+	}
+	videos := make([]savedVideo, 0, len(ids))
+	for _, id := range ids {
+		videoEntry, ok := safeVideoDataCollection.Read(id)
+		if !ok {
+			return nil, fmt.Errorf("video %s not found in videos.json", id)
+		}
+		videos = append(videos, savedVideo{id: id, entry: videoEntry})
+	}
+	return videos, nil
+}
+
+// statusOrder is the order of the statuses in the pipeline
+var statusOrder = []string{"pending", "downloaded", "processed", "transcribed", "indexed", "failed", "skipped", "quarantined"}
+
+func commandStatus(args []string) error {
+	flags, configFlags := newFlagSet("status")
+	parseArgs(flags, args)
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	videoDataCollection := safeVideoDataCollection.Copy()
+	counts := safeVideoDataCollection.CountByStatus()
+	var countReindex int
+	for _, video := range videoDataCollection {
+		if video.ReIndex && video.Status == "indexed" {
+			countReindex++
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "total\t%v\n", len(videoDataCollection))
+	for _, status := range statusOrder {
+		fmt.Fprintf(w, "%s\t%v\n", status, counts[status])
+	}
+	fmt.Fprintf(w, "pending re-index\t%v\n", countReindex)
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	// progress.json only exists while the pipeline is running
+	inProgress, err := readProgressFile(config.DataPath)
+	if err != nil {
+		return err
+	}
+	if len(inProgress) > 0 {
+		fmt.Println()
+		fmt.Println("in progress")
+		for _, progress := range inProgress {
+			fmt.Printf("  %s\n", progress.String())
+		}
+	}
+	return nil
+}
+
+func commandList(args []string) error {
+	flags, configFlags := newFlagSet("list")
+	status := flags.String("status", "", "only list videos with this status")
+	source := flags.String("source", "", "only list videos found in this source")
+	parseArgs(flags, args)
+
+	_, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	var videos []VideoData
+	for id, video := range safeVideoDataCollection.Copy() {
+		if *status != "" && video.Status != *status {
+			continue
+		}
+		if *source != "" && video.Source != *source {
+			continue
+		}
+		video.Id = id
+		videos = append(videos, video)
+	}
+	// newest first, the same as the default queue order
+	slices.SortFunc(videos, func(a VideoData, b VideoData) int {
+		if a.UploadDate != b.UploadDate {
+			return strings.Compare(b.UploadDate, a.UploadDate)
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tUPLOADED\tDURATION\tTITLE")
+	for _, video := range videos {
+		videoStatus := video.Status
+		if video.Status == "skipped" && video.SkipReason != "" {
+			videoStatus += " (" + video.SkipReason + ")"
+		}
+		if video.Status == "failed" && video.FailedStage != "" {
+			videoStatus += " (" + video.FailedStage + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", video.Id, videoStatus, video.UploadDate, video.Duration, video.Title)
+	}
+	return w.Flush()
+}
+
+func commandShow(args []string) error {
+	flags, configFlags := newFlagSet("show")
+	args = parseArgs(flags, args)
+	if len(args) != 1 {
+		return errors.New("usage: show <id>")
+	}
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	dataPath := config.DataPath
+	videos, err := readVideos(safeVideoDataCollection, args)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(videos[0].entry, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	for _, file := range videoFiles(dataPath, args[0]) {
+		fmt.Println(file)
+	}
+	return nil
+}
+
+// videoFiles returns the files of a video that exist in DATA_PATH
+func videoFiles(dataPath string, videoId string) []string {
+	var files []string
+	downloadedFilePath, ok := downloadedFile(filepath.Join(dataPath, "downloads"), videoId)
+	if ok {
+		files = append(files, downloadedFilePath)
+	}
+	candidates := []string{filepath.Join(dataPath, "processed", videoId+".wav")}
+	for _, ext := range transcriptExtensions {
+		candidates = append(candidates, filepath.Join(dataPath, "transcripts", videoId+ext))
+	}
+	candidates = append(candidates, enrichmentFilePath(filepath.Join(dataPath, "enrichments"), videoId))
+	for _, file := range candidates {
+		if fileExists(file) {
+			files = append(files, file)
+		}
+	}
+	// previous versions of the transcript
+	versionFiles, _ := filepath.Glob(filepath.Join(dataPath, "transcripts", "versions", videoId+".v*"))
+	return append(files, versionFiles...)
+}
+
+// resumeStatus returns the status of the last step of the video whose output
+// is still on disk so that a retried video does not redo finished steps
+func resumeStatus(dataPath string, videoId string) string {
+	if fileExists(filepath.Join(dataPath, "transcripts", videoId+".srt")) {
+		return "transcribed"
+	}
+	if fileExists(filepath.Join(dataPath, "processed", videoId+".wav")) {
+		return "processed"
+	}
+	if _, ok := downloadedFile(filepath.Join(dataPath, "downloads"), videoId); ok {
+		return "downloaded"
+	}
+	return "pending"
+}
+
+func clearFailures(videoEntry *VideoData) {
+	videoEntry.Failures = 0
+	videoEntry.FailedStage = ""
+	videoEntry.LastError = ""
+}
+
+func commandRetry(args []string) error {
+	flags, configFlags := newFlagSet("retry")
+	allFailed := flags.Bool("all-failed", false, "retry every failed video")
+	ids := parseArgs(flags, args)
+
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	dataPath := config.DataPath
+	if *allFailed {
+		for id, video := range safeVideoDataCollection.Copy() {
+			if video.Status == "failed" {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			fmt.Println("No failed videos to retry")
+			return nil
+		}
+	}
+	videos, err := readVideos(safeVideoDataCollection, ids)
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		if video.entry.Status != "failed" && video.entry.Failures == 0 {
+			return fmt.Errorf("video %s has not failed", video.id)
+		}
+	}
+	for _, video := range videos {
+		if video.entry.Status == "failed" {
+			video.entry.Status = resumeStatus(dataPath, video.id)
+		}
+		clearFailures(&video.entry)
+		safeVideoDataCollection.Write(video.id, video.entry)
+		fmt.Printf("%s will be retried from %s\n", video.id, video.entry.Status)
+	}
+	saveProgress(dataPath, safeVideoDataCollection)
+	return nil
+}
+
+func commandReset(args []string) error {
+	flags, configFlags := newFlagSet("reset")
+	to := flags.String("to", "pending", "the status to set, one of pending, downloaded, processed, transcribed or indexed")
+	ids := parseArgs(flags, args)
+
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	dataPath := config.DataPath
+	// the file the next step reads has to exist
+	var requiredFile func(videoId string) (string, bool)
+	switch *to {
+	case "pending", "indexed":
+	case "downloaded":
+		requiredFile = func(videoId string) (string, bool) {
+			return downloadedFile(filepath.Join(dataPath, "downloads"), videoId)
+		}
+	case "processed":
+		requiredFile = func(videoId string) (string, bool) {
+			file := filepath.Join(dataPath, "processed", videoId+".wav")
+			return file, fileExists(file)
+		}
+	case "transcribed":
+		requiredFile = func(videoId string) (string, bool) {
+			file := filepath.Join(dataPath, "transcripts", videoId+".srt")
+			return file, fileExists(file)
+		}
+	default:
+		return fmt.Errorf("unknown status %s, expected pending, downloaded, processed, transcribed or indexed", *to)
+	}
+
+	videos, err := readVideos(safeVideoDataCollection, ids)
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		if requiredFile == nil {
+			continue
+		}
+		file, ok := requiredFile(video.id)
+		if !ok {
+			return fmt.Errorf("unable to reset %s to %s, %s does not exist", video.id, *to, file)
+		}
+	}
+	for _, video := range videos {
+		video.entry.Status = *to
+		video.entry.ReIndex = false
+		video.entry.SkipReason = ""
+		clearFailures(&video.entry)
+		safeVideoDataCollection.Write(video.id, video.entry)
+		fmt.Printf("%s reset to %s\n", video.id, *to)
+	}
+	saveProgress(dataPath, safeVideoDataCollection)
+	return nil
+}
+
+func commandSkip(args []string) error {
+	flags, configFlags := newFlagSet("skip")
+	args = parseArgs(flags, args)
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	dataPath := config.DataPath
+	videos, err := readVideos(safeVideoDataCollection, args)
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		video.entry.Status = "skipped"
+		video.entry.SkipReason = manualSkipReason
+		video.entry.ReIndex = false
+		safeVideoDataCollection.Write(video.id, video.entry)
+		fmt.Printf("%s skipped\n", video.id)
+	}
+	saveProgress(dataPath, safeVideoDataCollection)
+	return nil
+}
+
+// commandPriority sets the priority of a video so that it can be moved to
+// the front of the queue without editing videos.json. 0 clears the priority
+func commandPriority(args []string) error {
+	flags, configFlags := newFlagSet("priority")
+	args = parseArgs(flags, args)
+	if len(args) != 2 {
+		return fmt.Errorf("expected a video id and a priority")
+	}
+	priority, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid priority %s, expected a whole number", args[1])
+	}
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	videos, err := readVideos(safeVideoDataCollection, args[:1])
+	if err != nil {
+		return err
+	}
+	video := videos[0]
+	video.entry.Priority = priority
+	safeVideoDataCollection.Write(video.id, video.entry)
+	fmt.Printf("%s priority set to %v\n", video.id, priority)
+	saveProgress(config.DataPath, safeVideoDataCollection)
+	return nil
+}
+
+// commandAdd adds videos to the queue without processing them. Filters are
+// not applied since the videos were picked by hand
+func commandAdd(args []string) error {
+	flags, configFlags := newFlagSet("add")
+	args = parseArgs(flags, args)
+	if len(args) == 0 {
+		return errors.New("usage: add <url|path>...")
+	}
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	_, err = addTargets(context.Background(), args, safeVideoDataCollection, config.Workers.VideoDetailFetch, config.StagePolicy())
+	saveProgress(config.DataPath, safeVideoDataCollection)
+	return err
+}
+
+// commandProcess runs the given videos through the pipeline right away
+// without checking the sources
+func commandProcess(args []string) error {
+	flags, configFlags := newFlagSet("process")
+	force := flags.Bool("force", false, "download and transcribe the videos again even if they have already been indexed")
+	targets := parseArgs(flags, args)
+	if len(targets) == 0 {
+		return errors.New("usage: process [--force] <id|url|path>...")
+	}
+	config, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	err = config.ValidateRun(false)
+	if err != nil {
+		return err
+	}
+	runPipeline(config, pipelineOptions{targets: targets, force: *force})
+	return nil
+}
+
+// commandRetranscribe transcribes transcribed and indexed videos again and
+// updates their documents. The current transcripts are kept as previous
+// versions
+func commandRetranscribe(args []string) error {
+	flags, configFlags := newFlagSet("retranscribe")
+	model := flags.String("model", "", "path of the whisper model to transcribe with, defaults to transcriber.model_path")
+	all := flags.Bool("all", false, "transcribe every video again whose transcript was not made with the model")
+	source := flags.String("source", "", "only transcribe videos found in this source again")
+	fromModel := flags.String("from-model", "", "only transcribe videos again whose transcript was made with this model file name, unknown for transcripts made before models were recorded")
+	ids := parseArgs(flags, args)
+	if *all == (len(ids) > 0) {
+		return errors.New("usage: retranscribe [--model <path>] [--source <url>] [--from-model <name>] --all | <id>...")
+	}
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	if *model != "" {
+		config.Transcribe.ModelPath = *model
+	}
+	err = config.ValidateRun(false)
+	if err != nil {
+		return err
+	}
+	modelName := filepath.Base(config.Transcribe.ModelPath)
+	if *all {
+		for id, video := range safeVideoDataCollection.Copy() {
+			if video.TranscriptVersion == nil || video.TranscriptVersion.Model != modelName {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		fmt.Println("No videos to transcribe again")
+		return nil
+	}
+	videos, err := readVideos(safeVideoDataCollection, ids)
+	if err != nil {
+		return err
+	}
+
+	var targets []string
+	transcriptsPath := filepath.Join(config.DataPath, "transcripts")
+	for _, video := range videos {
+		videoEntry := video.entry
+		if videoEntry.Status != "indexed" && videoEntry.Status != "transcribed" && videoEntry.Status != "quarantined" {
+			if !*all {
+				return fmt.Errorf("video %s has not been transcribed", video.id)
+			}
+			continue
+		}
+		if *source != "" && videoEntry.Source != *source {
+			continue
+		}
+		transcriptModel := "unknown"
+		if videoEntry.TranscriptVersion != nil {
+			transcriptModel = videoEntry.TranscriptVersion.Model
+		}
+		if *fromModel != "" && transcriptModel != *fromModel {
+			continue
+		}
+		err = archiveTranscript(transcriptsPath, video.id, &videoEntry, config.Transcribe.KeepVersions)
+		if err != nil {
+			return fmt.Errorf("unable to move the transcript of %s to the previous versions: %s", video.id, err.Error())
+		}
+		// the audio is downloaded again unless it is still on disk
+		videoEntry.Status = resumeStatus(config.DataPath, video.id)
+		videoEntry.Quality = nil
+		clearFailures(&videoEntry)
+		safeVideoDataCollection.Write(video.id, videoEntry)
+		targets = append(targets, video.id)
+	}
+	if len(targets) == 0 {
+		fmt.Println("No videos to transcribe again")
+		return nil
+	}
+	slog.Info(fmt.Sprintf("Transcribing %v videos again with %s", len(targets), modelName))
+	saveProgress(config.DataPath, safeVideoDataCollection)
+	runPipeline(config, pipelineOptions{targets: targets})
+	return nil
+}
+
+// youtubeVideoIdRegex matches the 11 characters of a YouTube video id so
+// that typos are not added to the queue as videos that never exist
+var youtubeVideoIdRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// addTargets adds videos given as ids, urls supported by yt-dlp or paths of
+// local files and directories, and returns the ids of all the videos. Ids
+// that are not in videos.json have to be valid YouTube video ids
+func addTargets(ctx context.Context, targets []string, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) ([]string, error) {
+	var ids []string
+	var errs []error
+	for _, target := range targets {
+		var videoRefs []VideoRef
+		var err error
+		source := Source{Type: "url", Url: target}
+		if _, statErr := os.Stat(target); statErr == nil {
+			source.Type = "local"
+			videoRefs, err = listLocalVideos(target)
+		} else if strings.Contains(target, "://") {
+			videoRefs, err = listUrlVideos(ctx, target, stagePolicy)
+		} else if _, ok := safeVideoDataCollection.Read(target); ok {
+			ids = append(ids, target)
+			continue
+		} else if youtubeVideoIdRegex.MatchString(target) {
+			videoRefs = []VideoRef{{Id: target, Url: youtubeVideoUrl(target)}}
+		} else {
+			errs = append(errs, fmt.Errorf("unable to add %s: not a file, url, YouTube video id or video in videos.json", target))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to add %s: %s", target, err.Error()))
+			continue
+		}
+		addNewVideosToQueue(ctx, videoRefs, source, safeVideoDataCollection, maxWorkers, stagePolicy)
+		for _, videoRef := range videoRefs {
+			// details that could not be fetched have been logged already
+			videoEntry, ok := safeVideoDataCollection.Read(videoRef.Id)
+			if !ok || videoEntry.Id == "" {
+				continue
+			}
+			ids = append(ids, videoRef.Id)
+		}
+	}
+	if len(ids) == 0 {
+		errs = append(errs, errors.New("none of the videos could be added"))
+	}
+	return ids, errors.Join(errs...)
+}
+
+// prepareTargets makes sure the videos processed on demand are not left out
+// because they failed or were skipped before. With force, videos are
+// processed again from the start and their transcripts are kept as previous
+// versions
+func prepareTargets(dataPath string, ids []string, force bool, keepVersions int, safeVideoDataCollection *SafeVideoDataCollection) {
+	for _, id := range ids {
+		videoEntry, ok := safeVideoDataCollection.Read(id)
+		if !ok {
+			continue
+		}
+		switch {
+		case force:
+			for _, ext := range downloadExtensions {
+				os.Remove(filepath.Join(dataPath, "downloads", id+ext))
+			}
+			os.Remove(filepath.Join(dataPath, "processed", id+".wav"))
+			err := archiveTranscript(filepath.Join(dataPath, "transcripts"), id, &videoEntry, keepVersions)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Unable to move the transcript of %s to the previous versions: %s", id, err.Error()))
+				continue
+			}
+			videoEntry.Status = "pending"
+			videoEntry.SkipReason = ""
+			videoEntry.ReIndex = false
+			videoEntry.Quality = nil
+		case videoEntry.Status == "failed":
+			videoEntry.Status = resumeStatus(dataPath, id)
+		case videoEntry.Status == "quarantined":
+			videoEntry.Status = "transcribed"
+		case videoEntry.Status == "skipped":
+			videoEntry.Status = "pending"
+			videoEntry.SkipReason = ""
+		case videoEntry.Status == "indexed" && !videoEntry.ReIndex:
+			slog.Info(fmt.Sprintf("%s has already been indexed, use --force to transcribe it again", id))
+		}
+		clearFailures(&videoEntry)
+		safeVideoDataCollection.Write(id, videoEntry)
+	}
+}
+
+// commandRemove removes videos along with their downloaded and processed
+// files. Transcripts are kept. Videos that are still in a source are added
+// again the next time the source is checked, use skip to keep them out
+func commandRemove(args []string) error {
+	flags, configFlags := newFlagSet("remove")
+	args = parseArgs(flags, args)
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	dataPath := config.DataPath
+	videos, err := readVideos(safeVideoDataCollection, args)
+	if err != nil {
+		return err
+	}
+
+	var searchClient meilisearch.ServiceManager
+	if config.Index.MeilisearchUrl != "" {
+		searchClient = meilisearch.New(config.Index.MeilisearchUrl, meilisearch.WithAPIKey(config.Index.MeilisearchApiKey))
+	}
+	for _, video := range videos {
+		for _, ext := range downloadExtensions {
+			os.Remove(filepath.Join(dataPath, "downloads", video.id+ext))
+		}
+		os.Remove(filepath.Join(dataPath, "processed", video.id+".wav"))
+		if searchClient != nil {
+			_, err := searchClient.Index("videos").DeleteDocument(video.id)
+			if err == nil {
+				_, err = searchClient.Index("segments").DeleteDocumentsByFilter(segmentsFilter([]string{video.id}))
+			}
+			if err != nil {
+				slog.Warn(fmt.Sprintf("Unable to delete %s from search index: %s", video.id, err.Error()))
+			}
+		}
+		safeVideoDataCollection.Delete(video.id)
+		fmt.Printf("%s removed\n", video.id)
+	}
+	saveProgress(dataPath, safeVideoDataCollection)
+	return nil
+}
+
+// commandReindex uploads the documents of videos again without transcribing
+// them, for example after the format of the documents has changed
+func commandReindex(args []string) error {
+	flags, configFlags := newFlagSet("reindex")
+	ids := parseArgs(flags, args)
+	config, safeVideoDataCollection, err := loadState(configFlags)
+	if err != nil {
+		return err
+	}
+	if config.Index.MeilisearchUrl == "" {
+		return errors.New("index.meilisearch_url (MEILISEARCH_URL) is not set")
+	}
+	if len(ids) == 0 {
+		for id, video := range safeVideoDataCollection.Copy() {
+			if video.Status == "indexed" {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			fmt.Println("No indexed videos to reindex")
+			return nil
+		}
+	}
+	videos, err := readVideos(safeVideoDataCollection, ids)
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		if video.entry.Status != "indexed" && video.entry.Status != "transcribed" {
+			return fmt.Errorf("video %s has not been transcribed", video.id)
+		}
+	}
+
+	searchClient := meilisearch.New(config.Index.MeilisearchUrl, meilisearch.WithAPIKey(config.Index.MeilisearchApiKey))
+	vectorizer := config.Vectorizer()
+	configureIndex(searchClient, vectorizer)
+	vocabulary, _ := NewVocabulary(config.Vocabulary)
+	transcriptsPath := filepath.Join(config.DataPath, "transcripts")
+	var documents []Document
+	var errs []error
+	for _, video := range videos {
+		document, err := buildDocument(transcriptsPath, filepath.Join(config.DataPath, "enrichments"), video.entry, vocabulary, safeVideoDataCollection)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		documents = append(documents, document)
+	}
+	for batch := range slices.Chunk(documents, maxIndexBatchSize) {
+		uploadDocumentsToMeilisearch(batch, searchClient, vectorizer, safeVideoDataCollection)
+	}
+	saveProgress(config.DataPath, safeVideoDataCollection)
+	return errors.Join(errs...)
+}
+
+// newSearcher connects to the search index of the config
+func newSearcher(config *Config, highlightPreTag string, highlightPostTag string) (*Searcher, error) {
+	if config.Index.MeilisearchUrl == "" {
+		return nil, errors.New("index.meilisearch_url (MEILISEARCH_URL) is not set")
+	}
+	searchClient := meilisearch.New(config.Index.MeilisearchUrl, meilisearch.WithAPIKey(config.Index.MeilisearchApiKey))
+	return NewSearcher(searchClient, config.Vectorizer(), highlightPreTag, highlightPostTag), nil
+}
+
+func commandSearch(args []string) error {
+	flags, configFlags := newFlagSet("search")
+	values := map[string]*string{}
+	for _, param := range searchParams {
+		values[param.name] = flags.String(param.name, "", param.usage)
+	}
+	asJson := flags.Bool("json", false, "print the results as json")
+	query := strings.Join(parseArgs(flags, args), " ")
+	if query == "" {
+		return errors.New("no query given")
+	}
+	options, err := parseSearchOptions(query, func(name string) string { return *values[name] })
+	if err != nil {
+		return err
+	}
+	config, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	// the terminal has no highlighting so matches are marked like markdown
+	searcher, err := newSearcher(config, "**", "**")
+	if err != nil {
+		return err
+	}
+	results, err := searcher.Search(context.Background(), options)
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+	fmt.Printf("About %v results for %q\n", results.EstimatedTotalHits, query)
+	for _, hit := range results.Hits {
+		fmt.Println()
+		fmt.Printf("%s (%s)\n", hit.Title, hit.Id)
+		fmt.Printf("  %s  uploaded %s  %s\n", hit.Url, hit.UploadDate, hit.Channel)
+		if hit.Snippet != "" {
+			fmt.Printf("  %s\n", hit.Snippet)
+		}
+		for _, moment := range hit.Moments {
+			fmt.Printf("  [%s] %s\n    %s\n", moment.Timestamp, moment.Text, moment.Url)
+		}
+	}
+	return nil
+}
+
+// commandServe serves the search api until it is stopped
+func commandServe(args []string) error {
+	flags, configFlags := newFlagSet("serve")
+	parseArgs(flags, args)
+	config, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	searcher, err := newSearcher(config, "<em>", "</em>")
+	if err != nil {
+		return err
+	}
+	return serveSearch(config.SearchAddr, searcher)
+}
+
+// commandConfig prints the config after the config file, env variables and
+// -set flags are merged so that it is clear which values are used
+func commandConfig(args []string) error {
+	flags, configFlags := newFlagSet("config")
+	args = parseArgs(flags, args)
+	if len(args) != 1 || args[0] != "print" {
+		return errors.New("usage: config print")
+	}
+	config, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(config.redacted())
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	return nil
+}
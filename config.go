@@ -0,0 +1,751 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is read from the config file, then env variables and finally the
+// -set flags, each overriding the values set before it
+type Config struct {
+	DataPath   string            `yaml:"data_path"`
+	Sources    SourcesConfig     `yaml:"sources"`
+	Workers    WorkersConfig     `yaml:"workers"`
+	Transcribe TranscriberConfig `yaml:"transcriber"`
+	Index      IndexConfig       `yaml:"index"`
+	Retention  RetentionConfig   `yaml:"retention"`
+	Timeouts   TimeoutsConfig    `yaml:"timeouts"`
+	Filters    FiltersConfig     `yaml:"filters"`
+	Quality    QualityConfig     `yaml:"quality"`
+	Enrich     EnrichConfig      `yaml:"enrich"`
+	Embeddings EmbeddingsConfig  `yaml:"embeddings"`
+	// Vocabulary can only be set in the config file
+	Vocabulary []VocabularyConfig `yaml:"vocabulary"`
+	// QueueOrder is newest, oldest or shortest
+	QueueOrder            string `yaml:"queue_order"`
+	StatusIntervalSeconds int    `yaml:"status_interval_seconds"`
+	MetricsAddr           string `yaml:"metrics_addr"`
+	// SearchAddr is where the serve command serves the search api
+	SearchAddr string `yaml:"search_addr"`
+}
+
+type SourcesConfig struct {
+	ChannelUrl   SourceEntry   `yaml:"channel_url"`
+	Urls         []SourceEntry `yaml:"urls"`
+	PodcastFeeds []SourceEntry `yaml:"podcast_feeds"`
+	LocalDirs    []SourceEntry `yaml:"local_dirs"`
+	// WatchSchedule is an interval such as 1h or a cron expression
+	WatchSchedule string `yaml:"watch_schedule"`
+	// DiscoveryMode is full or feed
+	DiscoveryMode    string   `yaml:"discovery_mode"`
+	FullScanInterval Duration `yaml:"full_scan_interval"`
+}
+
+// SourceEntry is a source given as its url, or as its directory for local
+// sources. Settings that only apply to one source are set by giving the
+// source as a mapping with the url under url
+type SourceEntry struct {
+	Url string `yaml:"url"`
+	// Filters are decoded on top of the filters block so that only the
+	// filters that are different for the source have to be set
+	Filters yaml.Node `yaml:"filters,omitempty"`
+	// WatchSchedule replaces the watch schedule of the sources block
+	WatchSchedule string `yaml:"watch_schedule,omitempty"`
+}
+
+func (se *SourceEntry) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		se.Url = value.Value
+		return nil
+	}
+	type sourceEntry SourceEntry
+	return decodeKnownFields(value, (*sourceEntry)(se))
+}
+
+// MarshalYAML writes sources without settings of their own as just the url
+func (se SourceEntry) MarshalYAML() (any, error) {
+	if se.Filters.IsZero() && se.WatchSchedule == "" {
+		return se.Url, nil
+	}
+	type sourceEntry SourceEntry
+	return sourceEntry(se), nil
+}
+
+// decodeKnownFields decodes a node like the config file is decoded, which
+// rejects keys that are not part of the config
+func decodeKnownFields(value *yaml.Node, out any) error {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	return decoder.Decode(out)
+}
+
+type WorkersConfig struct {
+	DownloadProcess  int `yaml:"download_process"`
+	VideoDetailFetch int `yaml:"video_detail_fetch"`
+	Transcribe       int `yaml:"transcribe"`
+}
+
+type TranscriberConfig struct {
+	ModelPath  string `yaml:"model_path"`
+	StreamMode bool   `yaml:"stream_mode"`
+	// OutputFormats are written along with the srt transcript, any of vtt,
+	// txt and json
+	OutputFormats []string `yaml:"output_formats"`
+	// KeepVersions is the number of previous transcripts kept for each
+	// video, 0 keeps all of them
+	KeepVersions int `yaml:"keep_versions"`
+	// Diarization labels the cues with who is speaking, either tinydiarize
+	// or command. Off when empty
+	Diarization string `yaml:"diarization"`
+	// DiarizerCommand is run with the path of the processed audio when
+	// diarization is command
+	DiarizerCommand []string `yaml:"diarizer_command"`
+}
+
+type IndexConfig struct {
+	MeilisearchUrl    string `yaml:"meilisearch_url"`
+	MeilisearchApiKey string `yaml:"meilisearch_api_key"`
+}
+
+type RetentionConfig struct {
+	MaxBacklogFiles  int `yaml:"max_backlog_files"`
+	MaxBacklogSizeMB int `yaml:"max_backlog_size_mb"`
+	MinFreeSpaceMB   int `yaml:"min_free_space_mb"`
+}
+
+type TimeoutsConfig struct {
+	MinStageTimeoutMinutes  int     `yaml:"min_stage_timeout_minutes"`
+	DownloadTimeoutFactor   float64 `yaml:"download_factor"`
+	ProcessTimeoutFactor    float64 `yaml:"process_factor"`
+	TranscribeTimeoutFactor float64 `yaml:"transcribe_factor"`
+	MaxRetries              int     `yaml:"max_retries"`
+}
+
+type FiltersConfig struct {
+	UploadedAfter   string   `yaml:"uploaded_after"`
+	UploadedBefore  string   `yaml:"uploaded_before"`
+	MinDuration     Duration `yaml:"min_duration"`
+	MaxDuration     Duration `yaml:"max_duration"`
+	TitleInclude    string   `yaml:"title_include"`
+	TitleExclude    string   `yaml:"title_exclude"`
+	SkipShorts      bool     `yaml:"skip_shorts"`
+	SkipLive        bool     `yaml:"skip_live"`
+	SkipMembersOnly bool     `yaml:"skip_members_only"`
+}
+
+type QualityConfig struct {
+	// Action is index, quarantine or retranscribe
+	Action                string   `yaml:"action"`
+	MinWordsPerMinute     float64  `yaml:"min_words_per_minute"`
+	MaxRepeatedShare      float64  `yaml:"max_repeated_share"`
+	RetranscribeModelPath string   `yaml:"retranscribe_model_path"`
+	RetranscribeArgs      []string `yaml:"retranscribe_args"`
+}
+
+type EnrichConfig struct {
+	// Url is the base url of an OpenAI compatible api such as
+	// http://localhost:8080/v1. Enrichment is disabled when empty
+	Url    string `yaml:"url"`
+	ApiKey string `yaml:"api_key"`
+	Model  string `yaml:"model"`
+	Prompt string `yaml:"prompt"`
+	// MaxTranscriptChars limits how much of the transcript is sent so that
+	// it fits in the context of the model, 0 sends all of it
+	MaxTranscriptChars int `yaml:"max_transcript_chars"`
+}
+
+type EmbeddingsConfig struct {
+	// Mode is user_provided or rest. Embeddings are disabled when empty
+	Mode string `yaml:"mode"`
+	// Embedder is the name of the embedder in Meilisearch
+	Embedder string `yaml:"embedder"`
+	// Client is the api of the embedding server, openai or ollama
+	Client string `yaml:"client"`
+	Url    string `yaml:"url"`
+	ApiKey string `yaml:"api_key"`
+	Model  string `yaml:"model"`
+	// Dimensions is the length of the vectors of the model, required in
+	// user_provided mode
+	Dimensions int `yaml:"dimensions"`
+	// MaxChars limits the text embedded for each document in user_provided
+	// mode, 0 embeds all of it
+	MaxChars int `yaml:"max_chars"`
+}
+
+type VocabularyConfig struct {
+	// Source is the url or directory of the source the prompt and
+	// replacements apply to, all sources when empty
+	Source       string              `yaml:"source"`
+	Prompt       string              `yaml:"prompt"`
+	Replacements []ReplacementConfig `yaml:"replacements"`
+}
+
+type ReplacementConfig struct {
+	Find    string `yaml:"find"`
+	Replace string `yaml:"replace"`
+	// Regex treats Find as a regular expression, otherwise only whole words
+	// are replaced
+	Regex         bool `yaml:"regex"`
+	CaseSensitive bool `yaml:"case_sensitive"`
+}
+
+// Duration is written as a string such as 30m or 24h in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	duration, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %v: %s", value.Line, err.Error())
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return d.String(), nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Sources: SourcesConfig{
+			WatchSchedule:    "1h",
+			DiscoveryMode:    "full",
+			FullScanInterval: Duration{24 * time.Hour},
+		},
+		Workers: WorkersConfig{
+			DownloadProcess:  1,
+			VideoDetailFetch: 10,
+			Transcribe:       1,
+		},
+		Timeouts: TimeoutsConfig{
+			MinStageTimeoutMinutes:  30,
+			DownloadTimeoutFactor:   2,
+			ProcessTimeoutFactor:    1,
+			TranscribeTimeoutFactor: 10,
+		},
+		Quality: QualityConfig{
+			Action:            qualityActionIndex,
+			MinWordsPerMinute: 20,
+			MaxRepeatedShare:  0.5,
+			// whisper.cpp is less likely to get stuck repeating itself
+			// without the text of previous segments as context
+			RetranscribeArgs: []string{"--max-context", "0", "--entropy-thold", "2.8"},
+		},
+		Enrich: EnrichConfig{
+			Prompt:             defaultEnrichPrompt,
+			MaxTranscriptChars: 24000,
+		},
+		Embeddings: EmbeddingsConfig{
+			Embedder: "default",
+			Client:   "openai",
+			MaxChars: 2000,
+		},
+		QueueOrder:            "newest",
+		StatusIntervalSeconds: 60,
+		SearchAddr:            ":8080",
+	}
+}
+
+// configFlags holds the -config and -set flags shared by all commands
+type configFlags struct {
+	path      string
+	overrides []string
+}
+
+func (cf *configFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&cf.path, "config", "", "path of the config file, defaults to CONFIG_PATH or config.yaml if it exists")
+	flags.Func("set", "override a config value such as workers.transcribe=2, can be repeated", func(value string) error {
+		if !strings.Contains(value, "=") {
+			return errors.New("expected key=value")
+		}
+		cf.overrides = append(cf.overrides, value)
+		return nil
+	})
+}
+
+// newFlagSet creates the flags of a command along with the config flags
+func newFlagSet(name string) (*flag.FlagSet, *configFlags) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	cf := &configFlags{}
+	cf.register(flags)
+	return flags, cf
+}
+
+// load reads the config and checks that the values are valid. Settings that
+// are only needed to run the pipeline are checked by ValidateRun
+func (cf *configFlags) load() (*Config, error) {
+	config := defaultConfig()
+
+	path := cf.path
+	if path == "" {
+		path = os.Getenv("CONFIG_PATH")
+	}
+	// the config file is optional when it is not given explicitly so that
+	// everything can still be set with env variables
+	explicit := path != ""
+	if path == "" {
+		path = "config.yaml"
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&config)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("unable to parse config file %s: %s", path, err.Error())
+		}
+	} else if explicit || !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read config file: %s", err.Error())
+	}
+
+	err = config.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	for _, override := range cf.overrides {
+		err = config.set(override)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// set overrides a single value given as a dotted key such as
+// workers.transcribe=2 by decoding it as yaml on top of the config
+func (c *Config) set(override string) error {
+	key, value, _ := strings.Cut(override, "=")
+	var node yaml.Node
+	err := yaml.Unmarshal([]byte(value), &node)
+	if err != nil {
+		return fmt.Errorf("-set %s is invalid: %s", override, err.Error())
+	}
+	var valueNode *yaml.Node
+	if len(node.Content) > 0 {
+		valueNode = node.Content[0]
+	} else {
+		valueNode = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+	}
+	parts := strings.Split(key, ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		valueNode = &yaml.Node{
+			Kind:    yaml.MappingNode,
+			Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: parts[i]}, valueNode},
+		}
+	}
+	data, err := yaml.Marshal(valueNode)
+	if err != nil {
+		return fmt.Errorf("-set %s is invalid: %s", override, err.Error())
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	if err != nil {
+		return fmt.Errorf("-set %s is invalid: %s", override, err.Error())
+	}
+	return nil
+}
+
+// applyEnv overrides the config with the env variables that are set
+func (c *Config) applyEnv() error {
+	var errs []error
+	envString(&c.DataPath, "DATA_PATH")
+	envString(&c.Sources.ChannelUrl.Url, "CHANNEL_URL")
+	envSources(&c.Sources.Urls, "SOURCE_URLS")
+	envSources(&c.Sources.PodcastFeeds, "PODCAST_FEED_URLS")
+	envSources(&c.Sources.LocalDirs, "LOCAL_MEDIA_DIRS")
+	envString(&c.Sources.WatchSchedule, "WATCH_SCHEDULE")
+	envString(&c.Sources.DiscoveryMode, "DISCOVERY_MODE")
+	errs = append(errs, envDuration(&c.Sources.FullScanInterval, "FULL_SCAN_INTERVAL"))
+	errs = append(errs, envInt(&c.Workers.DownloadProcess, "MAX_DOWNLOAD_PROCESS_WORKERS"))
+	errs = append(errs, envInt(&c.Workers.VideoDetailFetch, "MAX_VIDEO_DETAIL_FETCH_WORKERS"))
+	errs = append(errs, envInt(&c.Workers.Transcribe, "MAX_TRANSCRIBE_WORKERS"))
+	envString(&c.Transcribe.ModelPath, "WHISPER_MODEL_PATH")
+	errs = append(errs, envBool(&c.Transcribe.StreamMode, "STREAM_MODE"))
+	envList(&c.Transcribe.OutputFormats, "TRANSCRIPT_FORMATS")
+	errs = append(errs, envInt(&c.Transcribe.KeepVersions, "TRANSCRIPT_KEEP_VERSIONS"))
+	envString(&c.Transcribe.Diarization, "DIARIZATION")
+	envList(&c.Transcribe.DiarizerCommand, "DIARIZER_COMMAND")
+	envString(&c.Index.MeilisearchUrl, "MEILISEARCH_URL")
+	envString(&c.Index.MeilisearchApiKey, "MEILISEARCH_API_KEY")
+	errs = append(errs, envInt(&c.Retention.MaxBacklogFiles, "MAX_BACKLOG_FILES"))
+	errs = append(errs, envInt(&c.Retention.MaxBacklogSizeMB, "MAX_BACKLOG_SIZE_MB"))
+	errs = append(errs, envInt(&c.Retention.MinFreeSpaceMB, "MIN_FREE_SPACE_MB"))
+	errs = append(errs, envInt(&c.Timeouts.MinStageTimeoutMinutes, "MIN_STAGE_TIMEOUT_MINUTES"))
+	errs = append(errs, envFloat(&c.Timeouts.DownloadTimeoutFactor, "DOWNLOAD_TIMEOUT_FACTOR"))
+	errs = append(errs, envFloat(&c.Timeouts.ProcessTimeoutFactor, "PROCESS_TIMEOUT_FACTOR"))
+	errs = append(errs, envFloat(&c.Timeouts.TranscribeTimeoutFactor, "TRANSCRIBE_TIMEOUT_FACTOR"))
+	errs = append(errs, envInt(&c.Timeouts.MaxRetries, "MAX_RETRIES"))
+	envString(&c.Filters.UploadedAfter, "FILTER_UPLOADED_AFTER")
+	envString(&c.Filters.UploadedBefore, "FILTER_UPLOADED_BEFORE")
+	errs = append(errs, envDuration(&c.Filters.MinDuration, "FILTER_MIN_DURATION"))
+	errs = append(errs, envDuration(&c.Filters.MaxDuration, "FILTER_MAX_DURATION"))
+	envString(&c.Filters.TitleInclude, "FILTER_TITLE_INCLUDE")
+	envString(&c.Filters.TitleExclude, "FILTER_TITLE_EXCLUDE")
+	errs = append(errs, envBool(&c.Filters.SkipShorts, "FILTER_SKIP_SHORTS"))
+	errs = append(errs, envBool(&c.Filters.SkipLive, "FILTER_SKIP_LIVE"))
+	errs = append(errs, envBool(&c.Filters.SkipMembersOnly, "FILTER_SKIP_MEMBERS_ONLY"))
+	envString(&c.Quality.Action, "QUALITY_ACTION")
+	errs = append(errs, envFloat(&c.Quality.MinWordsPerMinute, "QUALITY_MIN_WORDS_PER_MINUTE"))
+	errs = append(errs, envFloat(&c.Quality.MaxRepeatedShare, "QUALITY_MAX_REPEATED_SHARE"))
+	envString(&c.Quality.RetranscribeModelPath, "QUALITY_RETRANSCRIBE_MODEL_PATH")
+	envList(&c.Quality.RetranscribeArgs, "QUALITY_RETRANSCRIBE_ARGS")
+	envString(&c.Enrich.Url, "ENRICH_URL")
+	envString(&c.Enrich.ApiKey, "ENRICH_API_KEY")
+	envString(&c.Enrich.Model, "ENRICH_MODEL")
+	envString(&c.Enrich.Prompt, "ENRICH_PROMPT")
+	errs = append(errs, envInt(&c.Enrich.MaxTranscriptChars, "ENRICH_MAX_TRANSCRIPT_CHARS"))
+	envString(&c.Embeddings.Mode, "EMBEDDINGS_MODE")
+	envString(&c.Embeddings.Embedder, "EMBEDDINGS_EMBEDDER")
+	envString(&c.Embeddings.Client, "EMBEDDINGS_CLIENT")
+	envString(&c.Embeddings.Url, "EMBEDDINGS_URL")
+	envString(&c.Embeddings.ApiKey, "EMBEDDINGS_API_KEY")
+	envString(&c.Embeddings.Model, "EMBEDDINGS_MODEL")
+	errs = append(errs, envInt(&c.Embeddings.Dimensions, "EMBEDDINGS_DIMENSIONS"))
+	errs = append(errs, envInt(&c.Embeddings.MaxChars, "EMBEDDINGS_MAX_CHARS"))
+	envString(&c.QueueOrder, "QUEUE_ORDER")
+	errs = append(errs, envInt(&c.StatusIntervalSeconds, "STATUS_INTERVAL_SECONDS"))
+	envString(&c.MetricsAddr, "METRICS_ADDR")
+	envString(&c.SearchAddr, "SEARCH_ADDR")
+	return errors.Join(errs...)
+}
+
+func envString(field *string, key string) {
+	value := os.Getenv(key)
+	if value != "" {
+		*field = value
+	}
+}
+
+// envSources replaces the sources with the urls in the env variable, which
+// have no settings of their own
+func envSources(field *[]SourceEntry, key string) {
+	var urls []string
+	envList(&urls, key)
+	if urls == nil {
+		return
+	}
+	*field = nil
+	for _, url := range urls {
+		*field = append(*field, SourceEntry{Url: url})
+	}
+}
+
+// envList splits a comma separated env variable
+func envList(field *[]string, key string) {
+	if os.Getenv(key) == "" {
+		return
+	}
+	var values []string
+	for value := range strings.SplitSeq(os.Getenv(key), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	*field = values
+}
+
+func envInt(field *int, key string) error {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s env variable is invalid: %s", key, err.Error())
+	}
+	*field = parsed
+	return nil
+}
+
+func envFloat(field *float64, key string) error {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("%s env variable is invalid: %s", key, err.Error())
+	}
+	*field = parsed
+	return nil
+}
+
+func envBool(field *bool, key string) error {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s env variable is invalid: %s", key, err.Error())
+	}
+	*field = parsed
+	return nil
+}
+
+func envDuration(field *Duration, key string) error {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s env variable is invalid: %s", key, err.Error())
+	}
+	field.Duration = parsed
+	return nil
+}
+
+// Validate checks the values of the config. Every problem is reported at
+// once so that they can all be fixed in one go
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Workers.DownloadProcess >= 1, "workers.download_process (MAX_DOWNLOAD_PROCESS_WORKERS) has to be at least 1")
+	check(c.Workers.VideoDetailFetch >= 1, "workers.video_detail_fetch (MAX_VIDEO_DETAIL_FETCH_WORKERS) has to be at least 1")
+	check(c.Workers.Transcribe >= 1, "workers.transcribe (MAX_TRANSCRIBE_WORKERS) has to be at least 1")
+	check(c.Retention.MaxBacklogFiles >= 0, "retention.max_backlog_files (MAX_BACKLOG_FILES) cannot be negative")
+	check(c.Retention.MaxBacklogSizeMB >= 0, "retention.max_backlog_size_mb (MAX_BACKLOG_SIZE_MB) cannot be negative")
+	check(c.Retention.MinFreeSpaceMB >= 0, "retention.min_free_space_mb (MIN_FREE_SPACE_MB) cannot be negative")
+	check(c.Timeouts.MinStageTimeoutMinutes >= 0, "timeouts.min_stage_timeout_minutes (MIN_STAGE_TIMEOUT_MINUTES) cannot be negative")
+	check(c.Timeouts.DownloadTimeoutFactor >= 0, "timeouts.download_factor (DOWNLOAD_TIMEOUT_FACTOR) cannot be negative")
+	check(c.Timeouts.ProcessTimeoutFactor >= 0, "timeouts.process_factor (PROCESS_TIMEOUT_FACTOR) cannot be negative")
+	check(c.Timeouts.TranscribeTimeoutFactor >= 0, "timeouts.transcribe_factor (TRANSCRIBE_TIMEOUT_FACTOR) cannot be negative")
+	check(c.Timeouts.MaxRetries >= 0, "timeouts.max_retries (MAX_RETRIES) cannot be negative")
+	check(c.StatusIntervalSeconds >= 0, "status_interval_seconds (STATUS_INTERVAL_SECONDS) cannot be negative")
+	check(c.Sources.DiscoveryMode == "full" || c.Sources.DiscoveryMode == "feed", "sources.discovery_mode (DISCOVERY_MODE) is %s, expected full or feed", c.Sources.DiscoveryMode)
+	for _, format := range c.Transcribe.OutputFormats {
+		_, ok := transcriptFormats[format]
+		check(ok, "transcriber.output_formats (TRANSCRIPT_FORMATS) has %s, expected vtt, txt or json", format)
+	}
+	check(c.Transcribe.KeepVersions >= 0, "transcriber.keep_versions (TRANSCRIPT_KEEP_VERSIONS) cannot be negative")
+	check(diarizationModes[c.Transcribe.Diarization], "transcriber.diarization (DIARIZATION) is %s, expected tinydiarize or command", c.Transcribe.Diarization)
+	if c.Transcribe.Diarization == diarizationCommand {
+		check(len(c.Transcribe.DiarizerCommand) > 0, "transcriber.diarizer_command (DIARIZER_COMMAND) has to be set when diarization is command")
+		check(!c.Transcribe.StreamMode, "transcriber.diarization (DIARIZATION) cannot be command in stream mode since the audio is not saved")
+	}
+	check(qualityActions[c.Quality.Action], "quality.action (QUALITY_ACTION) is %s, expected index, quarantine or retranscribe", c.Quality.Action)
+	check(c.Quality.MinWordsPerMinute >= 0, "quality.min_words_per_minute (QUALITY_MIN_WORDS_PER_MINUTE) cannot be negative")
+	check(c.Quality.MaxRepeatedShare >= 0 && c.Quality.MaxRepeatedShare <= 1, "quality.max_repeated_share (QUALITY_MAX_REPEATED_SHARE) has to be between 0 and 1")
+	check(c.Enrich.MaxTranscriptChars >= 0, "enrich.max_transcript_chars (ENRICH_MAX_TRANSCRIPT_CHARS) cannot be negative")
+	check(c.Enrich.Url == "" || c.Enrich.Prompt != "", "enrich.prompt (ENRICH_PROMPT) cannot be empty when enrich.url (ENRICH_URL) is set")
+	check(embeddingModes[c.Embeddings.Mode], "embeddings.mode (EMBEDDINGS_MODE) is %s, expected user_provided or rest", c.Embeddings.Mode)
+	_, ok := embeddingClients[c.Embeddings.Client]
+	check(ok, "embeddings.client (EMBEDDINGS_CLIENT) is %s, expected openai or ollama", c.Embeddings.Client)
+	check(c.Embeddings.Dimensions >= 0, "embeddings.dimensions (EMBEDDINGS_DIMENSIONS) cannot be negative")
+	check(c.Embeddings.MaxChars >= 0, "embeddings.max_chars (EMBEDDINGS_MAX_CHARS) cannot be negative")
+	if c.Embeddings.Mode != "" {
+		check(c.Embeddings.Url != "", "embeddings.url (EMBEDDINGS_URL) has to be set when embeddings.mode (EMBEDDINGS_MODE) is set")
+		check(c.Embeddings.Embedder != "", "embeddings.embedder (EMBEDDINGS_EMBEDDER) cannot be empty")
+	}
+	if c.Embeddings.Mode == embeddingModeUserProvided {
+		check(c.Embeddings.Dimensions > 0, "embeddings.dimensions (EMBEDDINGS_DIMENSIONS) has to be set in user_provided mode")
+	}
+	check(queueOrders[c.QueueOrder], "queue_order (QUEUE_ORDER) is %s, expected newest, oldest or shortest", c.QueueOrder)
+	_, err := parseSchedule(c.Sources.WatchSchedule)
+	check(err == nil, "sources.watch_schedule (WATCH_SCHEDULE) is invalid: %v", err)
+	_, err = c.VideoFilter(SourceEntry{})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, entry := range c.sourceEntries() {
+		if entry.WatchSchedule != "" {
+			_, err = parseSchedule(entry.WatchSchedule)
+			check(err == nil, "watch_schedule of source %s is invalid: %v", entry.Url, err)
+		}
+		if entry.Filters.IsZero() {
+			continue
+		}
+		_, err = c.VideoFilter(entry)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	_, err = NewVocabulary(c.Vocabulary)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateRun checks the settings that are only needed to run the pipeline.
+// Sources are not needed when only specific videos are processed
+func (c *Config) ValidateRun(needsSources bool) error {
+	var errs []error
+	if c.DataPath == "" {
+		errs = append(errs, errors.New("data_path (DATA_PATH) is not set"))
+	}
+	if c.Transcribe.ModelPath == "" {
+		errs = append(errs, errors.New("transcriber.model_path (WHISPER_MODEL_PATH) is not set"))
+	}
+	if needsSources && len(c.SourceList()) == 0 {
+		errs = append(errs, errors.New("no sources are set, set at least one of sources.channel_url (CHANNEL_URL), sources.urls (SOURCE_URLS), sources.podcast_feeds (PODCAST_FEED_URLS) or sources.local_dirs (LOCAL_MEDIA_DIRS)"))
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateState checks the settings needed by the commands that only work
+// on the state saved in DATA_PATH
+func (c *Config) ValidateState() error {
+	if c.DataPath == "" {
+		return errors.New("data_path (DATA_PATH) is not set")
+	}
+	return nil
+}
+
+func (c *Config) StagePolicy() *StagePolicy {
+	return NewStagePolicy(time.Duration(c.Timeouts.MinStageTimeoutMinutes)*time.Minute, c.Timeouts.DownloadTimeoutFactor, c.Timeouts.ProcessTimeoutFactor, c.Timeouts.TranscribeTimeoutFactor, c.Timeouts.MaxRetries)
+}
+
+func (c *Config) QualityPolicy() *QualityPolicy {
+	return NewQualityPolicy(c.Quality.Action, c.Quality.MinWordsPerMinute, c.Quality.MaxRepeatedShare, c.Quality.RetranscribeModelPath, c.Quality.RetranscribeArgs)
+}
+
+func (c *Config) Vectorizer() *Vectorizer {
+	var client EmbeddingClient
+	newClient, ok := embeddingClients[c.Embeddings.Client]
+	if ok {
+		client = newClient(c.Embeddings.Url, c.Embeddings.ApiKey, c.Embeddings.Model)
+	}
+	return NewVectorizer(c.Embeddings.Mode, c.Embeddings.Embedder, client, c.Embeddings.Dimensions, c.Embeddings.MaxChars)
+}
+
+// VideoFilter returns the filter of a source, which is the filters block
+// with the filters of the source on top
+func (c *Config) VideoFilter(entry SourceEntry) (*VideoFilter, error) {
+	filters := c.Filters
+	if !entry.Filters.IsZero() {
+		err := decodeKnownFields(&entry.Filters, &filters)
+		if err != nil {
+			return nil, fmt.Errorf("filters of source %s are invalid: %s", entry.Url, err.Error())
+		}
+	}
+	filter, err := filters.videoFilter()
+	if err != nil && entry.Url != "" {
+		return nil, fmt.Errorf("source %s: %w", entry.Url, err)
+	}
+	return filter, err
+}
+
+func (f FiltersConfig) videoFilter() (*VideoFilter, error) {
+	var filter VideoFilter
+	var err error
+	filter.UploadedAfter, err = parseFilterDate(f.UploadedAfter)
+	if err != nil {
+		return nil, fmt.Errorf("filters.uploaded_after (FILTER_UPLOADED_AFTER) is invalid: %s", err.Error())
+	}
+	filter.UploadedBefore, err = parseFilterDate(f.UploadedBefore)
+	if err != nil {
+		return nil, fmt.Errorf("filters.uploaded_before (FILTER_UPLOADED_BEFORE) is invalid: %s", err.Error())
+	}
+	filter.MinDuration = f.MinDuration.Duration
+	filter.MaxDuration = f.MaxDuration.Duration
+	if f.TitleInclude != "" {
+		filter.TitleInclude, err = regexp.Compile(f.TitleInclude)
+		if err != nil {
+			return nil, fmt.Errorf("filters.title_include (FILTER_TITLE_INCLUDE) is invalid: %s", err.Error())
+		}
+	}
+	if f.TitleExclude != "" {
+		filter.TitleExclude, err = regexp.Compile(f.TitleExclude)
+		if err != nil {
+			return nil, fmt.Errorf("filters.title_exclude (FILTER_TITLE_EXCLUDE) is invalid: %s", err.Error())
+		}
+	}
+	filter.SkipShorts = f.SkipShorts
+	filter.SkipLive = f.SkipLive
+	filter.SkipMembersOnly = f.SkipMembersOnly
+	return &filter, nil
+}
+
+// SourceList returns the sources to check for videos. The config has to be
+// valid
+func (c *Config) SourceList() []Source {
+	var sources []Source
+	if c.Sources.ChannelUrl.Url != "" {
+		filter, _ := c.VideoFilter(c.Sources.ChannelUrl)
+		sources = append(sources, Source{
+			Type:             "youtube",
+			Url:              c.Sources.ChannelUrl.Url,
+			Schedule:         c.watchSchedule(c.Sources.ChannelUrl),
+			UseFeed:          c.Sources.DiscoveryMode == "feed",
+			FullScanInterval: c.Sources.FullScanInterval.Duration,
+			Filter:           filter,
+		})
+	}
+	for _, entry := range c.Sources.Urls {
+		filter, _ := c.VideoFilter(entry)
+		sources = append(sources, Source{Type: "url", Url: entry.Url, Schedule: c.watchSchedule(entry), Filter: filter})
+	}
+	for _, entry := range c.Sources.PodcastFeeds {
+		filter, _ := c.VideoFilter(entry)
+		sources = append(sources, Source{Type: "podcast", Url: entry.Url, Schedule: c.watchSchedule(entry), Filter: filter})
+	}
+	for _, entry := range c.Sources.LocalDirs {
+		filter, _ := c.VideoFilter(entry)
+		sources = append(sources, Source{Type: "local", Url: entry.Url, Schedule: c.watchSchedule(entry), Filter: filter})
+	}
+	return sources
+}
+
+// watchSchedule returns the schedule of the source, or the schedule of the
+// sources block when the source has none of its own
+func (c *Config) watchSchedule(entry SourceEntry) cron.Schedule {
+	expr := c.Sources.WatchSchedule
+	if entry.WatchSchedule != "" {
+		expr = entry.WatchSchedule
+	}
+	schedule, _ := parseSchedule(expr)
+	return schedule
+}
+
+// sourceEntries returns the entries of all the sources that are set
+func (c *Config) sourceEntries() []SourceEntry {
+	var entries []SourceEntry
+	if c.Sources.ChannelUrl.Url != "" {
+		entries = append(entries, c.Sources.ChannelUrl)
+	}
+	entries = append(entries, c.Sources.Urls...)
+	entries = append(entries, c.Sources.PodcastFeeds...)
+	return append(entries, c.Sources.LocalDirs...)
+}
+
+// redacted returns a copy of the config that is safe to print
+func (c Config) redacted() Config {
+	if c.Index.MeilisearchApiKey != "" {
+		c.Index.MeilisearchApiKey = "REDACTED"
+	}
+	if c.Enrich.ApiKey != "" {
+		c.Enrich.ApiKey = "REDACTED"
+	}
+	if c.Embeddings.ApiKey != "" {
+		c.Embeddings.ApiKey = "REDACTED"
+	}
+	return c
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// diarization modes
+const (
+	// tinydiarize uses a whisper.cpp tdrz model which marks where the
+	// speaker changes in the transcript
+	diarizationTinydiarize = "tinydiarize"
+	// command runs a local diarizer on the processed audio
+	diarizationCommand = "command"
+)
+
+// diarizationModes are the valid diarization settings, off when empty
+var diarizationModes = map[string]bool{"": true, diarizationTinydiarize: true, diarizationCommand: true}
+
+// SpeakerTurn is a part of a video spoken by one speaker. Start and End are
+// in seconds from the start of the video
+type SpeakerTurn struct {
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Speaker string  `json:"speaker"`
+}
+
+// speakersFilePath is where the speaker turns of a video are saved
+func speakersFilePath(transcriptsPath string, videoId string) string {
+	return filepath.Join(transcriptsPath, videoId+".speakers.json")
+}
+
+// diarize saves the speaker turns of a video after it has been transcribed.
+// The audio file is only needed by the diarizer command. Speakers are only
+// an addition to the transcript so the video is indexed without them when
+// diarization fails
+func (w *Whisper) diarize(ctx context.Context, videoId string, audioFilePath string, transcriptsPath string) {
+	if w.diarization == "" || fileExists(speakersFilePath(transcriptsPath, videoId)) {
+		return
+	}
+	var turns []SpeakerTurn
+	var err error
+	switch w.diarization {
+	case diarizationTinydiarize:
+		turns, err = readSpeakerTurns(filepath.Join(transcriptsPath, videoId+".json"))
+	case diarizationCommand:
+		turns, err = runDiarizer(ctx, w.diarizerCommand, audioFilePath)
+	}
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(turns)
+		if err == nil {
+			err = os.WriteFile(speakersFilePath(transcriptsPath, videoId), data, 0666)
+		}
+	}
+	if err != nil {
+		stageFailures.WithLabelValues("diarize", "error").Inc()
+		slog.Error(fmt.Sprintf("Unable to diarize video %s, indexing it without speakers: %s", videoId, err.Error()))
+	}
+}
+
+// readSpeakerTurns reads the speaker changes marked by tinydiarize from the
+// json output of whisper-cli. tinydiarize only knows when the speaker
+// changes and not who is speaking, so the turns alternate between speakers
+// 1 and 2 which fits interviews and podcasts with two people
+func readSpeakerTurns(jsonFilePath string) ([]SpeakerTurn, error) {
+	data, err := os.ReadFile(jsonFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var transcript whisperTranscript
+	err = json.Unmarshal(data, &transcript)
+	if err != nil {
+		return nil, err
+	}
+	var turns []SpeakerTurn
+	speaker := 1
+	for _, segment := range transcript.Transcription {
+		start := float64(segment.Offsets.From) / 1000
+		end := float64(segment.Offsets.To) / 1000
+		if len(turns) > 0 && turns[len(turns)-1].Speaker == strconv.Itoa(speaker) {
+			turns[len(turns)-1].End = end
+		} else {
+			turns = append(turns, SpeakerTurn{Start: start, End: end, Speaker: strconv.Itoa(speaker)})
+		}
+		if segment.SpeakerTurnNext {
+			speaker = 3 - speaker
+		}
+	}
+	return turns, nil
+}
+
+// runDiarizer runs the diarizer command with the path of the audio file as
+// its last argument. The command has to print the speaker turns as a json
+// array of objects with start and end in seconds and a speaker label
+func runDiarizer(ctx context.Context, command []string, audioFilePath string) ([]SpeakerTurn, error) {
+	if !fileExists(audioFilePath) {
+		return nil, errors.New("the processed audio is not on disk")
+	}
+	args := append(command[1:len(command):len(command)], audioFilePath)
+	cmd := newCommand(ctx, command[0], args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err.Error(), stderr.String())
+	}
+	var turns []SpeakerTurn
+	err = json.Unmarshal(stdout.Bytes(), &turns)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the output of the diarizer: %s", err.Error())
+	}
+	return turns, nil
+}
+
+// readSpeakers labels each cue with the speaker who spoke for most of it
+func readSpeakers(speakersFilePath string, cues []Cue) error {
+	data, err := os.ReadFile(speakersFilePath)
+	if err != nil {
+		return err
+	}
+	var turns []SpeakerTurn
+	err = json.Unmarshal(data, &turns)
+	if err != nil {
+		return err
+	}
+	for i, cue := range cues {
+		var longest float64
+		for _, turn := range turns {
+			overlap := min(cue.End, turn.End) - max(cue.Start, turn.Start)
+			if overlap > longest {
+				longest = overlap
+				cues[i].Speaker = turn.Speaker
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// DiskGuard pauses downloads when too many files are waiting to be
+// processed or transcribed, or when the disk that holds DATA_PATH is
+// running out of free space. Limits set to 0 are not enforced
+type DiskGuard struct {
+	dataPath      string
+	backlogDirs   []string
+	maxFiles      int
+	maxBytes      int64
+	minFreeBytes  uint64
+	checkInterval time.Duration
+	// logInterval is how often a paused download is logged again so that
+	// it is clear why nothing is being downloaded
+	logInterval time.Duration
+	// safeVideoDataCollection is used to only count the files of videos
+	// that are waiting for the next step
+	safeVideoDataCollection *SafeVideoDataCollection
+	// jobTracker is used to only hold up downloads for the files of videos
+	// that are still in the pipeline
+	jobTracker *JobTracker
+}
+
+func NewDiskGuard(dataPath string, backlogDirs []string, maxFiles int, maxBytes int64, minFreeBytes uint64, safeVideoDataCollection *SafeVideoDataCollection, jobTracker *JobTracker) *DiskGuard {
+	_, err := freeSpace(dataPath)
+	if minFreeBytes > 0 && errors.Is(err, errors.ErrUnsupported) {
+		slog.Warn("Checking free disk space is not supported on this platform, MIN_FREE_SPACE_MB will be ignored")
+		minFreeBytes = 0
+	}
+	return &DiskGuard{
+		dataPath:                dataPath,
+		backlogDirs:             backlogDirs,
+		maxFiles:                maxFiles,
+		maxBytes:                maxBytes,
+		minFreeBytes:            minFreeBytes,
+		checkInterval:           30 * time.Second,
+		logInterval:             5 * time.Minute,
+		safeVideoDataCollection: safeVideoDataCollection,
+		jobTracker:              jobTracker,
+	}
+}
+
+// Backlog returns the number and total size of files waiting in the
+// backlog directories. Only the files of videos that are downloaded or
+// processed are counted, so partial downloads and files left behind by
+// failed, skipped or removed videos are not part of the backlog
+func (dg *DiskGuard) Backlog() (int, int64, error) {
+	return dg.backlog(false)
+}
+
+// backlog counts the files of the backlog. When inPipeline is set only the
+// files of videos that are still in the pipeline are counted. Videos whose
+// process or transcribe stage failed keep their status and file until they
+// are retried, and would otherwise hold up downloads for the rest of the run
+func (dg *DiskGuard) backlog(inPipeline bool) (int, int64, error) {
+	var files int
+	var size int64
+	for _, dir := range dg.backlogDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !dg.isWaiting(entry.Name(), inPipeline) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				// file may have been removed by a worker in the meantime
+				continue
+			}
+			files++
+			size += info.Size()
+		}
+	}
+	return files, size, nil
+}
+
+// isWaiting reports whether the file belongs to a video that is waiting to
+// be processed or transcribed. Files are named after the id of the video
+// followed by the extension
+func (dg *DiskGuard) isWaiting(fileName string, inPipeline bool) bool {
+	videoId, _, _ := strings.Cut(fileName, ".")
+	if inPipeline && !dg.jobTracker.InPipeline(videoId) {
+		return false
+	}
+	videoEntry, ok := dg.safeVideoDataCollection.Read(videoId)
+	return ok && (videoEntry.Status == "downloaded" || videoEntry.Status == "processed")
+}
+
+func (dg *DiskGuard) FreeSpace() (uint64, error) {
+	return freeSpace(dg.dataPath)
+}
+
+// Wait blocks until the backlog is below the configured limits and there
+// is enough free space to download another video. It returns the error of
+// the context if the context is cancelled while waiting
+func (dg *DiskGuard) Wait(ctx context.Context, videoId string) error {
+	isPaused := false
+	var pausedAt, loggedAt time.Time
+	for {
+		reason, err := dg.check()
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Unable to check disk usage, continuing download: %s", err.Error()))
+			return nil
+		}
+		if reason == "" {
+			if isPaused {
+				slog.Info(fmt.Sprintf("Resuming download of video %s", videoId))
+			}
+			return nil
+		}
+		if !isPaused {
+			slog.Info(fmt.Sprintf("Pausing download of video %s: %s", videoId, reason))
+			isPaused = true
+			pausedAt = time.Now()
+			loggedAt = pausedAt
+		} else if time.Since(loggedAt) >= dg.logInterval {
+			slog.Warn(fmt.Sprintf("Download of video %s has been paused for %s: %s", videoId, time.Since(pausedAt).Round(time.Second), reason))
+			loggedAt = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dg.checkInterval):
+		}
+	}
+}
+
+// check returns the reason downloads should be paused or an empty string if
+// downloads can continue
+func (dg *DiskGuard) check() (string, error) {
+	if dg.maxFiles > 0 || dg.maxBytes > 0 {
+		files, size, err := dg.backlog(true)
+		if err != nil {
+			return "", err
+		}
+		if dg.maxFiles > 0 && files >= dg.maxFiles {
+			return fmt.Sprintf("%v files are waiting to be processed or transcribed (max %v)", files, dg.maxFiles), nil
+		}
+		if dg.maxBytes > 0 && size >= dg.maxBytes {
+			return fmt.Sprintf("%v MB of files are waiting to be processed or transcribed (max %v MB)", size/bytesPerMB, dg.maxBytes/bytesPerMB), nil
+		}
+	}
+
+	if dg.minFreeBytes > 0 {
+		free, err := dg.FreeSpace()
+		if err != nil {
+			return "", err
+		}
+		if free < dg.minFreeBytes {
+			return fmt.Sprintf("only %v MB of free space left (min %v MB)", free/bytesPerMB, dg.minFreeBytes/bytesPerMB), nil
+		}
+	}
+	return "", nil
+}
+
+const bytesPerMB = 1024 * 1024
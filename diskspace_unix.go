@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	// Bavail is the space available to unprivileged users which is what
+	// matters when writing files to DATA_PATH
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
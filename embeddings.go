@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// embedding modes
+const (
+	// user_provided computes the embeddings of documents with the
+	// embedding client and uploads them with the documents
+	embeddingModeUserProvided = "user_provided"
+	// rest makes Meilisearch call the embedding server itself
+	embeddingModeRest = "rest"
+)
+
+var embeddingModes = map[string]bool{"": true, embeddingModeUserProvided: true, embeddingModeRest: true}
+
+// embeddingClients are the apis of embedding servers that are supported
+var embeddingClients = map[string]func(url string, apiKey string, model string) EmbeddingClient{
+	"openai": newOpenAIEmbeddingClient,
+	"ollama": newOllamaEmbeddingClient,
+}
+
+// embeddingBatchSize is the number of texts sent to the embedding server at
+// a time
+const embeddingBatchSize = 32
+
+// embeddingTimeout is how long the embeddings of a batch of documents can
+// take before the documents are uploaded without them
+const embeddingTimeout = 5 * time.Minute
+
+// EmbeddingClient turns texts into vectors with an embedding server
+type EmbeddingClient interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+	// RestEmbedder is the setting of a Meilisearch rest embedder that calls
+	// the same server
+	RestEmbedder() meilisearch.Embedder
+}
+
+// Vectorizer sets up semantic search on the indexes, either by computing the
+// embeddings of documents when they are uploaded or by letting Meilisearch
+// compute them
+type Vectorizer struct {
+	mode string
+	// name is the name of the embedder in Meilisearch which is given when
+	// searching
+	name       string
+	client     EmbeddingClient
+	dimensions int
+	maxChars   int
+}
+
+func NewVectorizer(mode string, name string, client EmbeddingClient, dimensions int, maxChars int) *Vectorizer {
+	return &Vectorizer{
+		mode:       mode,
+		name:       name,
+		client:     client,
+		dimensions: dimensions,
+		maxChars:   maxChars,
+	}
+}
+
+// documentTemplates are the texts Meilisearch embeds for the documents of
+// each index in rest mode. The transcript is cut short to fit in the context
+// of embedding models
+var documentTemplates = map[string]string{
+	"videos":   "{{doc.title}}. {{doc.summary}} {{doc.transcript|truncatewords: 300}}",
+	"segments": "{{doc.title}}. {{doc.chapter}} {{doc.text|truncatewords: 300}}",
+}
+
+// Settings returns the embedders of an index, nil when embeddings are
+// disabled
+func (v *Vectorizer) Settings(index string) map[string]meilisearch.Embedder {
+	switch v.mode {
+	case embeddingModeUserProvided:
+		return map[string]meilisearch.Embedder{v.name: {Source: "userProvided", Dimensions: v.dimensions}}
+	case embeddingModeRest:
+		embedder := v.client.RestEmbedder()
+		embedder.Dimensions = v.dimensions
+		embedder.DocumentTemplate = documentTemplates[index]
+		return map[string]meilisearch.Embedder{v.name: embedder}
+	}
+	return nil
+}
+
+// Add computes the embeddings of the documents and their segments in user
+// provided mode
+func (v *Vectorizer) Add(documents []Document) error {
+	if v.mode != embeddingModeUserProvided {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), embeddingTimeout)
+	defer cancel()
+	var texts []string
+	for _, document := range documents {
+		texts = append(texts, v.truncate(strings.Join([]string{document.Title, document.Summary, document.Transcript}, ". ")))
+		for _, segment := range document.Segments {
+			texts = append(texts, v.truncate(strings.Join([]string{segment.Title, segment.Chapter, segment.Text}, ". ")))
+		}
+	}
+	var vectors [][]float32
+	for i := 0; i < len(texts); i += embeddingBatchSize {
+		batch, err := v.client.Embed(ctx, texts[i:min(i+embeddingBatchSize, len(texts))])
+		if err != nil {
+			return err
+		}
+		vectors = append(vectors, batch...)
+	}
+	if len(vectors) != len(texts) {
+		return fmt.Errorf("embedding server returned %v embeddings for %v texts", len(vectors), len(texts))
+	}
+	for i := range documents {
+		documents[i].Vectors = map[string][]float32{v.name: vectors[0]}
+		vectors = vectors[1:]
+		for j := range documents[i].Segments {
+			documents[i].Segments[j].Vectors = map[string][]float32{v.name: vectors[0]}
+			vectors = vectors[1:]
+		}
+	}
+	return nil
+}
+
+// Hybrid returns the settings of a hybrid search with the embedder. In user
+// provided mode Meilisearch cannot embed the query so its vector is computed
+// and returned as well
+func (v *Vectorizer) Hybrid(ctx context.Context, query string, semanticRatio float64) (*meilisearch.SearchRequestHybrid, []float32, error) {
+	if v.mode == "" {
+		return nil, nil, errors.New("semantic search needs embeddings.mode (EMBEDDINGS_MODE) to be set")
+	}
+	hybrid := &meilisearch.SearchRequestHybrid{SemanticRatio: semanticRatio, Embedder: v.name}
+	if v.mode != embeddingModeUserProvided {
+		return hybrid, nil, nil
+	}
+	vectors, err := v.client.Embed(ctx, []string{v.truncate(query)})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(vectors) != 1 {
+		return nil, nil, fmt.Errorf("embedding server returned %v embeddings for 1 text", len(vectors))
+	}
+	return hybrid, vectors[0], nil
+}
+
+// truncate cuts the text short at a space to fit in the context of the
+// embedding model
+func (v *Vectorizer) truncate(text string) string {
+	if v.maxChars <= 0 || len(text) <= v.maxChars {
+		return text
+	}
+	text = text[:v.maxChars]
+	if i := strings.LastIndex(text, " "); i > 0 {
+		text = text[:i]
+	}
+	return text
+}
+
+// postJson sends a json request to an embedding server and decodes the json
+// response into response
+func postJson(ctx context.Context, url string, apiKey string, request any, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from embedding server: %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+// openAIEmbeddingClient calls the OpenAI compatible embeddings endpoint
+// served by llama.cpp, vLLM, LocalAI and others. The url is the base url of
+// the api such as http://localhost:8081/v1
+type openAIEmbeddingClient struct {
+	url    string
+	apiKey string
+	model  string
+}
+
+func newOpenAIEmbeddingClient(url string, apiKey string, model string) EmbeddingClient {
+	return &openAIEmbeddingClient{url: strings.TrimSuffix(url, "/") + "/embeddings", apiKey: apiKey, model: model}
+}
+
+func (c *openAIEmbeddingClient) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var response struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	err := postJson(ctx, c.url, c.apiKey, map[string]any{"model": c.model, "input": texts}, &response)
+	if err != nil {
+		return nil, err
+	}
+	// the embeddings are not guaranteed to be in the order of the input
+	vectors := make([][]float32, len(response.Data))
+	for _, data := range response.Data {
+		if data.Index < 0 || data.Index >= len(vectors) {
+			return nil, fmt.Errorf("embedding server returned an embedding for input %v of %v", data.Index, len(texts))
+		}
+		vectors[data.Index] = data.Embedding
+	}
+	return vectors, nil
+}
+
+func (c *openAIEmbeddingClient) RestEmbedder() meilisearch.Embedder {
+	return meilisearch.Embedder{
+		Source:   "rest",
+		URL:      c.url,
+		APIKey:   c.apiKey,
+		Request:  map[string]interface{}{"model": c.model, "input": "{{text}}"},
+		Response: map[string]interface{}{"data": []interface{}{map[string]interface{}{"embedding": "{{embedding}}"}}},
+	}
+}
+
+// ollamaEmbeddingClient calls the embed endpoint of Ollama. The url is the
+// url of the server such as http://localhost:11434
+type ollamaEmbeddingClient struct {
+	url    string
+	apiKey string
+	model  string
+}
+
+func newOllamaEmbeddingClient(url string, apiKey string, model string) EmbeddingClient {
+	return &ollamaEmbeddingClient{url: strings.TrimSuffix(url, "/") + "/api/embed", apiKey: apiKey, model: model}
+}
+
+func (c *ollamaEmbeddingClient) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var response struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	err := postJson(ctx, c.url, c.apiKey, map[string]any{"model": c.model, "input": texts}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Embeddings, nil
+}
+
+func (c *ollamaEmbeddingClient) RestEmbedder() meilisearch.Embedder {
+	return meilisearch.Embedder{
+		Source:   "rest",
+		URL:      c.url,
+		APIKey:   c.apiKey,
+		Request:  map[string]interface{}{"model": c.model, "input": "{{text}}"},
+		Response: map[string]interface{}{"embeddings": []interface{}{"{{embedding}}"}},
+	}
+}
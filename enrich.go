@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultEnrichPrompt asks for json so that the reply can be parsed. Local
+// models often wrap the json in a code block which is handled when parsing
+const defaultEnrichPrompt = `You are given the title and transcript of a video. Write a summary of the video in two or three sentences, list up to five topics it covers and up to ten keywords someone would search for to find it. Reply with only a JSON object of the form {"summary": "...", "topics": ["..."], "keywords": ["..."]}.`
+
+// Enrichment is the summary, topics and keywords of a video made by a
+// language model from its transcript
+type Enrichment struct {
+	Summary  string   `json:"summary"`
+	Topics   []string `json:"topics"`
+	Keywords []string `json:"keywords"`
+	// Hash is the hash of the model, prompt and transcript the enrichment
+	// was made from so that it is made again when any of them changes
+	Hash       string `json:"hash"`
+	Model      string `json:"model,omitempty"`
+	EnrichedAt string `json:"enrichedAt"`
+}
+
+// Enricher calls a local OpenAI compatible chat completions endpoint such as
+// the llama.cpp server to enrich videos
+type Enricher struct {
+	url                string
+	apiKey             string
+	model              string
+	prompt             string
+	maxTranscriptChars int
+	// enrichmentsPath is where enrichments are cached
+	enrichmentsPath string
+}
+
+func NewEnricher(config EnrichConfig, enrichmentsPath string) *Enricher {
+	return &Enricher{
+		url:                strings.TrimSuffix(config.Url, "/"),
+		apiKey:             config.ApiKey,
+		model:              config.Model,
+		prompt:             config.Prompt,
+		maxTranscriptChars: config.MaxTranscriptChars,
+		enrichmentsPath:    enrichmentsPath,
+	}
+}
+
+// enrichmentFilePath is where the enrichment of a video is cached
+func enrichmentFilePath(enrichmentsPath string, videoId string) string {
+	return filepath.Join(enrichmentsPath, videoId+".json")
+}
+
+// readEnrichment reads the cached enrichment of a video
+func readEnrichment(enrichmentsPath string, videoId string) (Enrichment, error) {
+	var enrichment Enrichment
+	data, err := os.ReadFile(enrichmentFilePath(enrichmentsPath, videoId))
+	if err != nil {
+		return enrichment, err
+	}
+	err = json.Unmarshal(data, &enrichment)
+	return enrichment, err
+}
+
+// Enrich makes the enrichment of a video from its transcript and caches it.
+// Nothing is sent to the model when the cached enrichment was made from the
+// same transcript with the same settings
+func (e *Enricher) Enrich(ctx context.Context, videoEntry VideoData, transcript string) error {
+	if e.maxTranscriptChars > 0 && len(transcript) > e.maxTranscriptChars {
+		// cut at a space so that the last word is not cut in half
+		transcript = transcript[:e.maxTranscriptChars]
+		if i := strings.LastIndex(transcript, " "); i > 0 {
+			transcript = transcript[:i]
+		}
+	}
+	input := fmt.Sprintf("Title: %s\n\nTranscript:\n%s", videoEntry.Title, transcript)
+	sum := sha256.Sum256([]byte(e.model + "\x00" + e.prompt + "\x00" + input))
+	hash := hex.EncodeToString(sum[:])
+	cached, err := readEnrichment(e.enrichmentsPath, videoEntry.Id)
+	if err == nil && cached.Hash == hash {
+		return nil
+	}
+
+	reply, err := e.complete(ctx, input)
+	if err != nil {
+		return err
+	}
+	enrichment, err := parseEnrichment(reply)
+	if err != nil {
+		return err
+	}
+	enrichment.Hash = hash
+	enrichment.Model = e.model
+	enrichment.EnrichedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.MarshalIndent(enrichment, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(enrichmentFilePath(e.enrichmentsPath, videoEntry.Id), data, 0666)
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	// Model can be left out for servers that only serve one model
+	Model       string        `json:"model,omitempty"`
+	Messages    []chatMessage `json:"messages"`
+	Temperature float64       `json:"temperature"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// complete sends the prompt and the input to the model and returns its reply
+func (e *Enricher) complete(ctx context.Context, input string) (string, error) {
+	body, err := json.Marshal(chatRequest{
+		Model: e.model,
+		Messages: []chatMessage{
+			{Role: "system", Content: e.prompt},
+			{Role: "user", Content: input},
+		},
+		// a low temperature keeps the summaries to the point
+		Temperature: 0.2,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status from chat completions endpoint: %s", res.Status)
+	}
+	var response chatResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return "", err
+	}
+	if len(response.Choices) == 0 {
+		return "", errors.New("chat completions endpoint returned no reply")
+	}
+	return response.Choices[0].Message.Content, nil
+}
+
+// parseEnrichment parses the json object in the reply of the model,
+// ignoring any text around it
+func parseEnrichment(reply string) (Enrichment, error) {
+	var enrichment Enrichment
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start == -1 || end < start {
+		return enrichment, fmt.Errorf("reply of the model has no json object: %q", reply)
+	}
+	err := json.Unmarshal([]byte(reply[start:end+1]), &enrichment)
+	if err != nil {
+		return enrichment, fmt.Errorf("unable to parse the reply of the model: %s", err.Error())
+	}
+	if enrichment.Summary == "" {
+		return enrichment, errors.New("reply of the model has no summary")
+	}
+	return enrichment, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the channel feed only lists the 15 most recent uploads, so a full scan of
+// the channel is still needed every now and then to catch anything missed
+const channelFeedUrl = "https://www.youtube.com/feeds/videos.xml?channel_id="
+
+type ChannelFeed struct {
+	Entries []ChannelFeedEntry `xml:"entry"`
+}
+
+type ChannelFeedEntry struct {
+	VideoId   string `xml:"http://www.youtube.com/xml/schemas/2015 videoId"`
+	Title     string `xml:"title"`
+	Published string `xml:"published"`
+}
+
+// parseChannelFeed reads the Atom feed of a YouTube channel. Entries
+// without a video id are skipped since they cannot be queued
+func parseChannelFeed(r io.Reader) ([]ChannelFeedEntry, error) {
+	var feed ChannelFeed
+	err := xml.NewDecoder(r).Decode(&feed)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ChannelFeedEntry, 0, len(feed.Entries))
+	for _, entry := range feed.Entries {
+		if strings.TrimSpace(entry.VideoId) == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func fetchChannelFeed(ctx context.Context, channelId string) ([]ChannelFeedEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, channelFeedUrl+channelId, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching channel feed: %s", res.Status)
+	}
+	return parseChannelFeed(res.Body)
+}
+
+var channelIdRegex = regexp.MustCompile(`/channel/(UC[\w-]{22})`)
+
+// resolveChannelId gets the channel id from the url if possible, otherwise
+// yt-dlp is used to look up the channel of the latest video
+func resolveChannelId(ctx context.Context, url string, stagePolicy *StagePolicy) (string, error) {
+	match := channelIdRegex.FindStringSubmatch(url)
+	if match != nil {
+		return match[1], nil
+	}
+	ctx, cancel := stagePolicy.Context(ctx, "metadata", "")
+	defer cancel()
+	cmdFetch := newCommand(ctx, "yt-dlp", "--print", "%(channel_id)s", "--playlist-items", "1", url)
+	out, err := cmdFetch.Output()
+	if err != nil {
+		return "", err
+	}
+	channelId := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(channelId, "UC") {
+		return "", fmt.Errorf("unable to find channel id for %s: %s", url, channelId)
+	}
+	return channelId, nil
+}
+
+type SourceState struct {
+	ChannelId    string    `json:"channelId,omitempty"`
+	LastFullScan time.Time `json:"lastFullScan"`
+}
+
+// SourceStates is saved in sources.json so that the time of the last full
+// scan of each source is kept across runs
+type SourceStates struct {
+	path   string
+	states map[string]SourceState
+	mu     sync.Mutex
+}
+
+func loadSourceStates(dataPath string) (*SourceStates, error) {
+	sourceStates := &SourceStates{
+		path:   filepath.Join(dataPath, "sources.json"),
+		states: map[string]SourceState{},
+	}
+	data, err := os.ReadFile(sourceStates.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sourceStates, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &sourceStates.states)
+	if err != nil {
+		return nil, err
+	}
+	return sourceStates, nil
+}
+
+func (ss *SourceStates) Read(url string) SourceState {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.states[url]
+}
+
+func (ss *SourceStates) Write(url string, state SourceState) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.states[url] = state
+	data, err := json.MarshalIndent(ss.states, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ss.path, data, 0666)
+}
+
+// discoverVideos adds the videos of a source to the queue. Sources that use
+// the channel feed only check the feed for recent uploads and do a full scan
+// of the channel once the full scan interval has passed or when the feed is
+// not available
+func discoverVideos(ctx context.Context, source Source, isUpdate bool, sourceStates *SourceStates, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) error {
+	switch source.Type {
+	case "local":
+		return gatherLocalVideos(ctx, source, isUpdate, safeVideoDataCollection, maxWorkers, stagePolicy)
+	case "url":
+		return gatherUrlVideos(ctx, source, isUpdate, safeVideoDataCollection, maxWorkers, stagePolicy)
+	case "podcast":
+		return gatherPodcastEpisodes(ctx, source, isUpdate, safeVideoDataCollection, stagePolicy)
+	}
+
+	state := sourceStates.Read(source.Url)
+	if !source.UseFeed || isUpdate || time.Since(state.LastFullScan) >= source.FullScanInterval {
+		return fullScan(ctx, source, isUpdate, sourceStates, safeVideoDataCollection, maxWorkers, stagePolicy)
+	}
+
+	if state.ChannelId == "" {
+		channelId, err := resolveChannelId(ctx, source.Url, stagePolicy)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Unable to find channel id, falling back to full scan: %s", err.Error()))
+			return fullScan(ctx, source, isUpdate, sourceStates, safeVideoDataCollection, maxWorkers, stagePolicy)
+		}
+		state.ChannelId = channelId
+		err = sourceStates.Write(source.Url, state)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Unable to save sources.json: %s", err.Error()))
+		}
+	}
+
+	slog.Info("Checking channel feed for new videos")
+	entries, err := fetchChannelFeed(ctx, state.ChannelId)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Unable to fetch channel feed, falling back to full scan: %s", err.Error()))
+		return fullScan(ctx, source, isUpdate, sourceStates, safeVideoDataCollection, maxWorkers, stagePolicy)
+	}
+	videoRefs := make([]VideoRef, 0, len(entries))
+	for _, entry := range entries {
+		videoRefs = append(videoRefs, VideoRef{Id: entry.VideoId, Url: youtubeVideoUrl(entry.VideoId)})
+	}
+	addNewVideosToQueue(ctx, videoRefs, source, safeVideoDataCollection, maxWorkers, stagePolicy)
+	return nil
+}
+
+func fullScan(ctx context.Context, source Source, isUpdate bool, sourceStates *SourceStates, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) error {
+	err := gatherVideos(ctx, source, isUpdate, safeVideoDataCollection, maxWorkers, stagePolicy)
+	if err != nil {
+		return err
+	}
+	state := sourceStates.Read(source.Url)
+	state.LastFullScan = time.Now()
+	err = sourceStates.Write(source.Url, state)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Unable to save sources.json: %s", err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChannelFeed(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/channel_feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		input   string
+		want    []ChannelFeedEntry
+		wantErr bool
+	}{
+		{
+			// the entry without a video id is left out
+			name:  "fixture",
+			input: string(fixture),
+			want: []ChannelFeedEntry{
+				{VideoId: "dQw4w9WgXcQ", Title: "First video & more", Published: "2026-10-01T15:00:06+00:00"},
+				{VideoId: "9bZkp7q19f0", Title: "Second video", Published: "2026-09-24T12:30:00+00:00"},
+				{VideoId: "jNQXAC9IVRw", Title: "Third video without a published date"},
+			},
+		},
+		{
+			name:  "no entries",
+			input: `<feed xmlns="http://www.w3.org/2005/Atom"><title>Empty</title></feed>`,
+			want:  []ChannelFeedEntry{},
+		},
+		{
+			name:    "truncated",
+			input:   `<feed xmlns="http://www.w3.org/2005/Atom"><entry><title>Cut off`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChannelFeed(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseChannelFeed error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseChannelFeed = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
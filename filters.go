@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VideoFilter decides which videos of a source are skipped instead of being
+// downloaded. Fields that are not set do not filter anything
+type VideoFilter struct {
+	// dates are in the YYYYMMDD format used by yt-dlp for upload_date
+	UploadedAfter   string
+	UploadedBefore  string
+	MinDuration     time.Duration
+	MaxDuration     time.Duration
+	TitleInclude    *regexp.Regexp
+	TitleExclude    *regexp.Regexp
+	SkipShorts      bool
+	SkipLive        bool
+	SkipMembersOnly bool
+}
+
+// videos skipped for these reasons are checked again the next time the
+// channel is checked since live streams and premieres become regular videos
+// once they are over
+var recheckSkipReasons = map[string]bool{
+	"live":     true,
+	"upcoming": true,
+}
+
+// shorts can be up to 3 minutes long
+const maxShortsDuration = 3 * time.Minute
+
+// manualSkipReason is the reason of videos skipped with the skip command,
+// which stay skipped whatever the filters are
+const manualSkipReason = "manual"
+
+// Evaluate returns the reason the video should be skipped along with a
+// description for the logs, or an empty reason if the video passes the filter
+func (vf *VideoFilter) Evaluate(metadata VideoMetadata) (string, string) {
+	if vf == nil {
+		return "", ""
+	}
+	if vf.SkipLive {
+		switch metadata.LiveStatus {
+		case "is_live", "post_live":
+			return "live", "video is a live stream that has not finished processing"
+		case "is_upcoming":
+			return "upcoming", "video is an upcoming live stream or premiere"
+		}
+	}
+	if vf.SkipMembersOnly && metadata.Availability == "subscriber_only" {
+		return "members_only", "video is only available to channel members"
+	}
+	// the other filters need the details of the video
+	if metadata.DetailsUnavailable {
+		return "", ""
+	}
+
+	uploadDate := metadata.UploadDate
+	if vf.UploadedAfter != "" && uploadDate != "NA" && uploadDate < vf.UploadedAfter {
+		return "uploaded_before", fmt.Sprintf("uploaded on %s which is before %s", uploadDate, vf.UploadedAfter)
+	}
+	if vf.UploadedBefore != "" && uploadDate != "NA" && uploadDate > vf.UploadedBefore {
+		return "uploaded_after", fmt.Sprintf("uploaded on %s which is after %s", uploadDate, vf.UploadedBefore)
+	}
+
+	seconds, err := strconv.ParseFloat(metadata.Duration, 64)
+	// videos with unknown duration are not filtered by duration
+	if err == nil {
+		duration := time.Duration(seconds * float64(time.Second))
+		if vf.SkipShorts && duration <= maxShortsDuration && metadata.Height > metadata.Width {
+			return "short", "video is a YouTube Short"
+		}
+		if vf.MinDuration > 0 && duration < vf.MinDuration {
+			return "too_short", fmt.Sprintf("duration %v is shorter than %v", duration, vf.MinDuration)
+		}
+		if vf.MaxDuration > 0 && duration > vf.MaxDuration {
+			return "too_long", fmt.Sprintf("duration %v is longer than %v", duration, vf.MaxDuration)
+		}
+	}
+
+	if vf.TitleInclude != nil && !vf.TitleInclude.MatchString(metadata.Title) {
+		return "title_not_included", fmt.Sprintf("title does not match %s", vf.TitleInclude.String())
+	}
+	if vf.TitleExclude != nil && vf.TitleExclude.MatchString(metadata.Title) {
+		return "title_excluded", fmt.Sprintf("title matches %s", vf.TitleExclude.String())
+	}
+	return "", ""
+}
+
+// parseFilterDate accepts dates as YYYYMMDD or YYYY-MM-DD and returns them
+// as YYYYMMDD so that they can be compared with upload dates from yt-dlp
+func parseFilterDate(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	date, err := time.Parse("20060102", strings.ReplaceAll(value, "-", ""))
+	if err != nil {
+		return "", fmt.Errorf("expected date as YYYYMMDD or YYYY-MM-DD: %s", value)
+	}
+	return date.Format("20060102"), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// searchableAttributes are the fields of a document that are searched, in
+// order of importance. The cues are left out since their text is already in
+// the transcript
+var searchableAttributes = []string{"title", "topics", "keywords", "summary", "transcript", "description"}
+
+var filterableAttributes = []string{"speakers", "topics", "keywords", "channel", "source", "uploadDay", "durationSeconds"}
+
+// segmentSearchableAttributes and segmentFilterableAttributes are the
+// settings of the segments index. Segments are filtered by video when the
+// segments of a video are replaced
+var segmentSearchableAttributes = []string{"chapter", "text", "title"}
+var segmentFilterableAttributes = []string{"videoId", "type", "speaker"}
+
+// segment types
+const (
+	segmentTypeChapter = "chapter"
+	segmentTypeSpeaker = "speaker"
+)
+
+// configureIndex updates the settings of the indexes. Meilisearch only
+// reindexes the documents when the settings change
+func configureIndex(searchClient meilisearch.ServiceManager, vectorizer *Vectorizer) {
+	_, err := searchClient.Index("videos").UpdateSearchableAttributes(&searchableAttributes)
+	if err == nil {
+		_, err = searchClient.Index("videos").UpdateFilterableAttributes(&filterableAttributes)
+	}
+	if err == nil {
+		_, err = searchClient.Index("segments").UpdateSearchableAttributes(&segmentSearchableAttributes)
+	}
+	if err == nil {
+		_, err = searchClient.Index("segments").UpdateFilterableAttributes(&segmentFilterableAttributes)
+	}
+	// embedders that were set up before embeddings were disabled are kept
+	// so that the vectors are not lost
+	for _, index := range []string{"videos", "segments"} {
+		embedders := vectorizer.Settings(index)
+		if err == nil && embedders != nil {
+			_, err = searchClient.Index(index).UpdateEmbedders(embedders)
+		}
+	}
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Unable to update search index settings: %s", err.Error()))
+	}
+}
+
+// buildDocument creates the document of a video from its transcript, details
+// and enrichment. The corrections of the vocabulary are made in the
+// transcript and saved on the video
+func buildDocument(transcriptsPath string, enrichmentsPath string, videoEntry VideoData, vocabulary *Vocabulary, safeVideoDataCollection *SafeVideoDataCollection) (Document, error) {
+	_, cues, err := readTranscript(filepath.Join(transcriptsPath, fmt.Sprintf("%s.srt", videoEntry.Id)))
+	if err != nil {
+		return Document{}, err
+	}
+	// the words are only available when the json transcript is written.
+	// They are added before the corrections so that they are corrected too
+	jsonFilePath := filepath.Join(transcriptsPath, fmt.Sprintf("%s.json", videoEntry.Id))
+	if fileExists(jsonFilePath) {
+		words, err := readWords(jsonFilePath)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Unable to read words of %s: %s", videoEntry.Id, err.Error()))
+		} else {
+			addWords(cues, words)
+		}
+	}
+	corrections := vocabulary.Apply(videoEntry.Source, cues)
+	if len(corrections) > 0 || len(videoEntry.Corrections) > 0 {
+		savedEntry, ok := safeVideoDataCollection.Read(videoEntry.Id)
+		if ok {
+			savedEntry.Corrections = corrections
+			safeVideoDataCollection.Write(videoEntry.Id, savedEntry)
+		}
+	}
+	// the speakers are only available when the video was diarized
+	speakersPath := speakersFilePath(transcriptsPath, videoEntry.Id)
+	if fileExists(speakersPath) {
+		err := readSpeakers(speakersPath, cues)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Unable to read speakers of %s: %s", videoEntry.Id, err.Error()))
+		}
+	}
+	document := Document{
+		Transcript: transcriptText(cues),
+		Cues:       cues,
+	}
+	if videoEntry.TranscriptVersion != nil {
+		document.TranscriptModel = videoEntry.TranscriptVersion.Model
+		document.TranscriptVersion = videoEntry.TranscriptVersion.Version
+	}
+	document.Id = videoEntry.Id
+	document.Url = videoUrl(videoEntry)
+	document.Title = videoEntry.Title
+	document.UploadDate = videoEntry.UploadDate
+	document.Duration = videoEntry.Duration
+	document.Description = videoEntry.Description
+	document.Channel = videoEntry.Channel
+	document.Source = videoEntry.Source
+	// the upload date and duration are NA when they are not known
+	document.UploadDay, _ = strconv.Atoi(videoEntry.UploadDate)
+	document.DurationSeconds, _ = strconv.ParseFloat(videoEntry.Duration, 64)
+	// the enrichment is only available when enrichment is enabled
+	enrichment, err := readEnrichment(enrichmentsPath, videoEntry.Id)
+	if err == nil {
+		document.Summary = enrichment.Summary
+		document.Topics = enrichment.Topics
+		document.Keywords = enrichment.Keywords
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn(fmt.Sprintf("Unable to read enrichment of %s: %s", videoEntry.Id, err.Error()))
+	}
+	document.Segments = chapterSegments(document, videoEntry.Chapters)
+	var speakerTurns []SegmentDocument
+	document.Speakers, speakerTurns = speakerSegments(document)
+	document.Segments = append(document.Segments, speakerTurns...)
+	return document, nil
+}
+
+// chapterSegments splits the transcript into the chapters of the video. A
+// cue belongs to the chapter it starts in
+func chapterSegments(document Document, chapters []Chapter) []SegmentDocument {
+	var segments []SegmentDocument
+	for i, chapter := range chapters {
+		var cues []Cue
+		for _, cue := range document.Cues {
+			if cue.Start >= chapter.Start && cue.Start < chapter.End {
+				cues = append(cues, cue)
+			}
+		}
+		segments = append(segments, SegmentDocument{
+			Id:         fmt.Sprintf("%s-%s-%v", document.Id, segmentTypeChapter, i+1),
+			VideoId:    document.Id,
+			Type:       segmentTypeChapter,
+			Chapter:    chapter.Title,
+			Start:      chapter.Start,
+			End:        chapter.End,
+			Text:       transcriptText(cues),
+			Title:      document.Title,
+			Url:        document.Url,
+			UploadDate: document.UploadDate,
+		})
+	}
+	return segments
+}
+
+// speakerSegments joins the consecutive cues of each speaker into segments
+// and returns the speakers in the order they first speak
+func speakerSegments(document Document) ([]string, []SegmentDocument) {
+	var speakers []string
+	var turns [][]Cue
+	for _, cue := range document.Cues {
+		if cue.Speaker == "" {
+			continue
+		}
+		if !slices.Contains(speakers, cue.Speaker) {
+			speakers = append(speakers, cue.Speaker)
+		}
+		last := len(turns) - 1
+		if last >= 0 && turns[last][0].Speaker == cue.Speaker {
+			turns[last] = append(turns[last], cue)
+		} else {
+			turns = append(turns, []Cue{cue})
+		}
+	}
+	var segments []SegmentDocument
+	for i, turn := range turns {
+		segments = append(segments, SegmentDocument{
+			Id:         fmt.Sprintf("%s-%s-%v", document.Id, segmentTypeSpeaker, i+1),
+			VideoId:    document.Id,
+			Type:       segmentTypeSpeaker,
+			Speaker:    turn[0].Speaker,
+			Start:      turn[0].Start,
+			End:        turn[len(turn)-1].End,
+			Text:       transcriptText(turn),
+			Title:      document.Title,
+			Url:        document.Url,
+			UploadDate: document.UploadDate,
+		})
+	}
+	return speakers, segments
+}
@@ -0,0 +1,54 @@
+package main
+
+import "sync"
+
+// JobTracker keeps track of the videos that are in the pipeline so that a
+// video is not added to the queues again while it is still being worked on
+type JobTracker struct {
+	inFlight map[string]bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+func NewJobTracker() *JobTracker {
+	return &JobTracker{
+		inFlight: map[string]bool{},
+	}
+}
+
+// Add returns false if the video is already in the pipeline
+func (jt *JobTracker) Add(videoId string) bool {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	if jt.inFlight[videoId] {
+		return false
+	}
+	jt.inFlight[videoId] = true
+	jt.wg.Add(1)
+	return true
+}
+
+// Done has to be called once a video leaves the pipeline, either because it
+// has been indexed or because one of the stages failed
+func (jt *JobTracker) Done(videoId string) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	if !jt.inFlight[videoId] {
+		return
+	}
+	delete(jt.inFlight, videoId)
+	jt.wg.Done()
+}
+
+// InPipeline reports whether the video has been added and has not left the
+// pipeline yet
+func (jt *JobTracker) InPipeline(videoId string) bool {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	return jt.inFlight[videoId]
+}
+
+// Wait blocks until all videos that were added have left the pipeline
+func (jt *JobTracker) Wait() {
+	jt.wg.Wait()
+}
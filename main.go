@@ -1,167 +1,345 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strconv"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/meilisearch/meilisearch-go"
 )
 
 func main() {
-	isUpdate := flag.Bool("u", false, "update details/metadata of videos in queue and set them to be reindexed")
-	flag.Parse()
-
 	godotenv.Load(".env")
-	dataPath := os.Getenv("DATA_PATH")
-	if dataPath == "" {
-		slog.Error(fmt.Sprintln("DATA_PATH env variable is not set"))
-		os.Exit(1)
-	}
-	channelUrl := os.Getenv("CHANNEL_URL")
-	if channelUrl == "" {
-		slog.Error(fmt.Sprintln("CHANNEL_URL env variable is not set"))
-		os.Exit(1)
+	// running without a command runs the pipeline so that the -u and -w
+	// flags keep working on their own
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
-	whisperModelPath := os.Getenv("WHISPER_MODEL_PATH")
-	if whisperModelPath == "" {
-		slog.Error(fmt.Sprintln("WHISPER_MODEL_PATH env variable is not set"))
-		os.Exit(1)
-	}
-	maxDownloadAndProcessWorkers, err := strconv.Atoi(os.Getenv("MAX_DOWNLOAD_PROCESS_WORKERS"))
+	err := runCommand(command, args)
 	if err != nil {
-		slog.Error(fmt.Sprintf("MAX_DOWNLOAD_PROCESS_WORKERS env variable is invalid: %s", err.Error()))
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
-	maxVideoDetailFetchWorkers, err := strconv.Atoi(os.Getenv("MAX_VIDEO_DETAIL_FETCH_WORKERS"))
+}
+
+// run gathers the videos of all the sources and runs them through the
+// pipeline
+func run(args []string) error {
+	flags, configFlags := newFlagSet("run")
+	isUpdate := flags.Bool("u", false, "update details/metadata of videos in queue and set them to be reindexed")
+	isWatch := flags.Bool("w", false, "keep running and check the channel for new videos on the schedule set by WATCH_SCHEDULE")
+	flags.Parse(args)
+	config, err := configFlags.load()
 	if err != nil {
-		slog.Error(fmt.Sprintf("MAX_VIDEO_DETAIL_FETCH_WORKERS env variable is invalid: %s", err.Error()))
-		os.Exit(1)
+		return err
 	}
-	maxTranscribeWorkers, err := strconv.Atoi(os.Getenv("MAX_TRANSCRIBE_WORKERS"))
+	err = config.ValidateRun(true)
 	if err != nil {
-		slog.Error(fmt.Sprintf("MAX_TRANSCRIBE_WORKERS env variable is invalid: %s", err.Error()))
-		os.Exit(1)
+		return err
+	}
+	runPipeline(config, pipelineOptions{isUpdate: *isUpdate, isWatch: *isWatch})
+	return nil
+}
+
+type pipelineOptions struct {
+	isUpdate bool
+	isWatch  bool
+	// targets are the ids, urls or paths of the only videos to process, in
+	// which case the sources are not checked
+	targets []string
+	// force processes the targets again from the start
+	force bool
+}
+
+func runPipeline(config *Config, options pipelineOptions) {
+	dataPath := config.DataPath
+	maxDownloadAndProcessWorkers := config.Workers.DownloadProcess
+	maxVideoDetailFetchWorkers := config.Workers.VideoDetailFetch
+	maxTranscribeWorkers := config.Workers.Transcribe
+	// streaming mode is optional and disabled by default
+	isStream := config.Transcribe.StreamMode
+	stagePolicy := config.StagePolicy()
+	qualityPolicy := config.QualityPolicy()
+	// the vocabulary has been validated with the config
+	vocabulary, _ := NewVocabulary(config.Vocabulary)
+	whisper := NewWhisper(config.Transcribe, qualityPolicy, vocabulary)
+	vectorizer := config.Vectorizer()
+	// the sources are not checked when only specific videos are processed
+	var sources []Source
+	if len(options.targets) == 0 {
+		sources = config.SourceList()
 	}
 
-	searchClient, err := meilisearch.Connect(os.Getenv("MEILISEARCH_URL"), meilisearch.WithAPIKey(os.Getenv("MEILISEARCH_API_KEY")))
+	searchClient, err := meilisearch.Connect(config.Index.MeilisearchUrl, meilisearch.WithAPIKey(config.Index.MeilisearchApiKey))
 	if err != nil {
 		slog.Error(fmt.Sprintf("Unable to connect to meilisearch: %s\n", err.Error()))
+	} else {
+		configureIndex(searchClient, vectorizer)
 	}
 
 	slog.Info(fmt.Sprintf("Setting project directory to %s", dataPath))
-	slog.Info(fmt.Sprintf("Downloading and Processing videos for %s", channelUrl))
+	for _, source := range sources {
+		slog.Info(fmt.Sprintf("Downloading and Processing videos for %s", source.Url))
+	}
 	err = initDataDir(dataPath)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Unable to initialize project folder: %v", err.Error()))
 		os.Exit(1)
 	}
 
-	// progress for each video is saved in videos.json
-	videosJsonData, err := os.ReadFile(filepath.Join(dataPath, "videos.json"))
+	downloadDir := filepath.Join(dataPath, "downloads")
+	// the downloaded file has to be converted to a specific format for
+	// whisper to transcribe it (check whisper.cpp documentation for details)
+	processedDir := filepath.Join(dataPath, "processed")
+	transcriptsDir := filepath.Join(dataPath, "transcripts")
+	// summaries, topics and keywords made by the language model are cached
+	// so that they are only made again when the transcript changes
+	enrichmentsDir := filepath.Join(dataPath, "enrichments")
+	isEnrich := config.Enrich.Url != ""
+
+	// the time of the last full scan of each source is saved in sources.json
+	sourceStates, err := loadSourceStates(dataPath)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Unable to read videos.json: %v", err.Error()))
+		slog.Error(fmt.Sprintf("Unable to read sources.json: %v", err.Error()))
 		os.Exit(1)
 	}
 
-	safeVideoDataCollection := SafeVideoDataCollection{}
-	initialVideoDataCollection := VideoDataCollection{}
-	err = json.Unmarshal(videosJsonData, &initialVideoDataCollection)
+	// progress for each video is saved in videos.json
+	initialVideoDataCollection, err := loadProgress(dataPath)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Unable to unmarshall videos.json: %v", err.Error()))
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
+	safeVideoDataCollection := SafeVideoDataCollection{}
 	safeVideoDataCollection.videosDataAndStatus = initialVideoDataCollection
 
+	jobTracker := NewJobTracker()
+
+	// downloads are paused while too many files are waiting in the
+	// downloads and processed directories or free space is running low
+	diskGuard := NewDiskGuard(dataPath, []string{downloadDir, processedDir}, config.Retention.MaxBacklogFiles, int64(config.Retention.MaxBacklogSizeMB)*bytesPerMB, uint64(config.Retention.MinFreeSpaceMB)*bytesPerMB, &safeVideoDataCollection, jobTracker)
+
+	// metrics are only served when an address such as :9090 is set
+	if config.MetricsAddr != "" {
+		go serveMetrics(config.MetricsAddr, &safeVideoDataCollection)
+	}
+
+	// cancelling the context kills all the commands that are still running
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// gracefully shutdown on interrupt signal
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
+		cancel()
+		// the commands run in their own process groups so they do not get
+		// the interrupt and have to be killed before exiting. Killed
+		// commands are waited for at most 10 seconds by newCommand
+		slog.Info("Interrupted, waiting for running commands to stop")
+		if !stagePolicy.Wait(15 * time.Second) {
+			slog.Warn("Some commands did not stop in time and may still be running")
+		}
+		removeProgressFile(dataPath)
 		saveProgress(dataPath, &safeVideoDataCollection)
-		printSummary(&safeVideoDataCollection, maxDownloadAndProcessWorkers, maxVideoDetailFetchWorkers, maxTranscribeWorkers)
+		printSummary(&safeVideoDataCollection, maxDownloadAndProcessWorkers, maxVideoDetailFetchWorkers, maxTranscribeWorkers, diskGuard)
 
 		os.Exit(130)
 	}()
 
-	err = gatherVideos(channelUrl, *isUpdate, &safeVideoDataCollection, maxVideoDetailFetchWorkers)
-	if err != nil {
-		slog.Warn(fmt.Sprintf("Unable to gather videos: %v", err.Error()))
+	// only the target videos are enqueued when processing specific videos
+	var targetIds map[string]bool
+	if len(options.targets) > 0 {
+		ids, err := addTargets(ctx, options.targets, &safeVideoDataCollection, maxVideoDetailFetchWorkers, stagePolicy)
+		if err != nil {
+			slog.Error(err.Error())
+			if len(ids) == 0 {
+				os.Exit(1)
+			}
+		}
+		prepareTargets(dataPath, ids, options.force, config.Transcribe.KeepVersions, &safeVideoDataCollection)
+		targetIds = map[string]bool{}
+		for _, id := range ids {
+			targetIds[id] = true
+		}
+	}
+	for _, source := range sources {
+		err = discoverVideos(ctx, source, options.isUpdate, sourceStates, &safeVideoDataCollection, maxVideoDetailFetchWorkers, stagePolicy)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Unable to gather videos: %v", err.Error()))
+		}
 	}
 
-	printSummary(&safeVideoDataCollection, maxDownloadAndProcessWorkers, maxVideoDetailFetchWorkers, maxTranscribeWorkers)
-
-	downloadDir := filepath.Join(dataPath, "downloads")
-	// the downloaded file has to be converted to a specific format for
-	// whisper to transcribe it (check whisper.cpp documentation for details)
-	processedDir := filepath.Join(dataPath, "processed")
-	transcriptsDir := filepath.Join(dataPath, "transcripts")
+	printSummary(&safeVideoDataCollection, maxDownloadAndProcessWorkers, maxVideoDetailFetchWorkers, maxTranscribeWorkers, diskGuard)
 
 	downloadQueue := make(chan string)
 	processQueue := make(chan string)
 	transcribeQueue := make(chan string)
 	indexQueue := make(chan string)
+	streamQueue := make(chan string)
+	enrichQueue := make(chan string)
+	// transcribed videos go through the enrich stage when it is enabled
+	transcribedQueue, transcribedStage := indexQueue, "index"
+	if isEnrich {
+		transcribedQueue, transcribedStage = enrichQueue, "enrich"
+	}
+
+	scheduler, err := NewScheduler(config.QueueOrder)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if isStream {
+		scheduler.Start("stream", streamQueue)
+	} else {
+		scheduler.Start("download", downloadQueue)
+	}
+	scheduler.Start("process", processQueue)
+	scheduler.Start("transcribe", transcribeQueue)
+	if isEnrich {
+		scheduler.Start("enrich", enrichQueue)
+	}
+	scheduler.Start("index", indexQueue)
 
-	var wg sync.WaitGroup
+	progressTracker := NewProgressTracker()
+	// 0 disables logging the progress of videos in progress at an interval,
+	// progress is still logged at every 10%
+	if config.StatusIntervalSeconds > 0 {
+		go progressTracker.LogStatus(time.Duration(config.StatusIntervalSeconds) * time.Second)
+	}
+	// the status command reads the progress from progress.json
+	go progressTracker.SaveStatus(dataPath, progressFileInterval)
 
 	// n+1 (n = number of transcribe workers) concurrent workers for downloading and processing is sufficient
 	// as transcribing is the bottleneck. This can be increased to create
 	// a larger buffer of downloaded and processed videos
 
 	for range maxDownloadAndProcessWorkers {
-		go downloadWorker(downloadQueue, processQueue, downloadDir, &safeVideoDataCollection)
-		go processWorker(processQueue, transcribeQueue, downloadDir, processedDir, &safeVideoDataCollection)
+		// in streaming mode nothing is downloaded to disk but process workers
+		// are still needed for videos downloaded before streaming was enabled
+		if !isStream {
+			go downloadWorker(ctx, downloadQueue, processQueue, downloadDir, diskGuard, stagePolicy, progressTracker, &safeVideoDataCollection, jobTracker)
+		}
+		go processWorker(ctx, processQueue, transcribeQueue, downloadDir, processedDir, stagePolicy, &safeVideoDataCollection, jobTracker)
 	}
 
 	// 1 is recommended, can be increased if more system resources are available to run multiple LLM processes at the same time
 	for range maxTranscribeWorkers {
-		go transcribeWorker(transcribeQueue, indexQueue, processedDir, transcriptsDir, whisperModelPath, &safeVideoDataCollection)
+		if isStream {
+			go streamWorker(ctx, streamQueue, transcribeQueue, transcribedQueue, transcribedStage, processedDir, transcriptsDir, whisper, stagePolicy, qualityPolicy, progressTracker, &safeVideoDataCollection, jobTracker)
+		} else {
+			go transcribeWorker(ctx, transcribeQueue, transcribedQueue, transcribedStage, processedDir, transcriptsDir, whisper, stagePolicy, qualityPolicy, progressTracker, &safeVideoDataCollection, jobTracker)
+		}
 	}
 
 	// indexWorker uploades batches of json files to meilisearch, hence
 	// one worker is sufficient
-	go indexWorker(indexQueue, transcriptsDir, searchClient, &safeVideoDataCollection, &wg)
-
-	for id, video := range safeVideoDataCollection.videosDataAndStatus {
-		switch video.Status {
-		case "pending":
-			slog.Info("Adding to download queue")
-			wg.Add(1)
-			downloadQueue <- id
-		case "downloaded":
-			slog.Info("Adding to process queue")
-			wg.Add(1)
-			processQueue <- id
-		case "processed":
-			slog.Info("Adding to transcribe queue")
-			wg.Add(1)
-			transcribeQueue <- id
-		case "transcribed":
-			slog.Info("Adding to index queue")
-			wg.Add(1)
-			indexQueue <- id
-		case "indexed":
-		default:
-			slog.Error(fmt.Sprintf("Unexpected video status: %s", video.Status))
-		}
+	go indexWorker(indexQueue, transcriptsDir, enrichmentsDir, vocabulary, searchClient, vectorizer, &safeVideoDataCollection, jobTracker)
 
-		if video.ReIndex && video.Status == "indexed" {
-			slog.Info("Adding to index queue (reindex)")
-			wg.Add(1)
-			indexQueue <- id
+	// the language model is usually served by a single local server so one
+	// worker is sufficient
+	if isEnrich {
+		enricher := NewEnricher(config.Enrich, enrichmentsDir)
+		go enrichWorker(ctx, enrichQueue, indexQueue, transcriptsDir, enricher, vocabulary, stagePolicy, &safeVideoDataCollection)
+	}
+
+	// adds every video that is not already in the pipeline to the queue of
+	// the next stage it has to go through. The scheduler decides the order
+	// in which they are sent to the workers
+	enqueueVideos := func() {
+		videosByStage := map[string][]scheduledVideo{}
+		for id, video := range safeVideoDataCollection.Copy() {
+			if targetIds != nil && !targetIds[id] {
+				continue
+			}
+			// a video that was interrupted while being streamed can be marked
+			// as downloaded or processed without the file existing on disk,
+			// even once streaming mode has been turned off
+			status := video.Status
+			if status == "downloaded" {
+				if _, ok := downloadedFile(downloadDir, id); !ok {
+					status = "pending"
+				}
+			}
+			if status == "processed" && !fileExists(filepath.Join(processedDir, fmt.Sprintf("%s.wav", id))) {
+				status = "pending"
+			}
+
+			var stage string
+			switch status {
+			case "pending":
+				// local files do not have to be downloaded
+				if _, isLocal := localFilePath(video.Url); isLocal {
+					stage = "process"
+				} else if isStream {
+					stage = "stream"
+				} else {
+					stage = "download"
+				}
+			case "downloaded":
+				stage = "process"
+			case "processed":
+				stage = "transcribe"
+			case "transcribed":
+				stage = transcribedStage
+			case "indexed":
+				// enrichments are cached so reindexed videos are only sent
+				// to the language model again when their transcript changed
+				if video.ReIndex {
+					stage = transcribedStage
+				}
+			case "failed", "skipped", "quarantined":
+				// failed videos are skipped until they are reset, videos
+				// skipped by filters are not downloaded and quarantined
+				// transcripts are not indexed until they are reset
+			default:
+				slog.Error(fmt.Sprintf("Unexpected video status: %s", video.Status))
+			}
+
+			if stage == "" || !jobTracker.Add(id) {
+				continue
+			}
+			slog.Info(fmt.Sprintf("Adding %s to %s queue", id, stage))
+			videosByStage[stage] = append(videosByStage[stage], scheduledVideo{id: id, video: video})
 		}
+		for stage, videos := range videosByStage {
+			scheduler.Push(stage, videos)
+		}
+	}
+
+	if options.isWatch {
+		// save progress regularly since the program only stops when it is
+		// interrupted
+		go func() {
+			for range time.Tick(time.Minute) {
+				saveProgress(dataPath, &safeVideoDataCollection)
+			}
+		}()
+		enqueueVideos()
+		watchSources(ctx, sources, func(source Source) error {
+			return discoverVideos(ctx, source, false, sourceStates, &safeVideoDataCollection, maxVideoDetailFetchWorkers, stagePolicy)
+		}, func() {
+			saveProgress(dataPath, &safeVideoDataCollection)
+			// videos already in the pipeline are skipped so feeding the
+			// queues again only adds the newly gathered videos
+			enqueueVideos()
+		})
+		return
 	}
 
-	wg.Wait()
+	enqueueVideos()
+	jobTracker.Wait()
 
+	removeProgressFile(dataPath)
 	saveProgress(dataPath, &safeVideoDataCollection)
-	printSummary(&safeVideoDataCollection, maxDownloadAndProcessWorkers, maxVideoDetailFetchWorkers, maxTranscribeWorkers)
+	printSummary(&safeVideoDataCollection, maxDownloadAndProcessWorkers, maxVideoDetailFetchWorkers, maxTranscribeWorkers, diskGuard)
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// videoDetailsTemplate makes yt-dlp print the fields needed for VideoDetails
+// as a single line of json per video instead of the full -j output which
+// includes every available format and can be megabytes per video
+const videoDetailsTemplate = "%(.{id,title,upload_date,duration,live_status,availability,width,height,webpage_url,original_url,chapters,channel,uploader})j"
+
+type ytdlpVideoDetails struct {
+	Id           string   `json:"id"`
+	Title        string   `json:"title"`
+	UploadDate   *string  `json:"upload_date"`
+	Duration     *float64 `json:"duration"`
+	LiveStatus   string   `json:"live_status"`
+	Availability string   `json:"availability"`
+	Width        int      `json:"width"`
+	Height       int      `json:"height"`
+	WebpageUrl   string   `json:"webpage_url"`
+	OriginalUrl  string   `json:"original_url"`
+	// Channel is only set for sites with channels, the uploader is used
+	// for other sites
+	Channel  string `json:"channel"`
+	Uploader string `json:"uploader"`
+	// Chapters are null when the video has no chapters
+	Chapters []struct {
+		Title     string  `json:"title"`
+		StartTime float64 `json:"start_time"`
+		EndTime   float64 `json:"end_time"`
+	} `json:"chapters"`
+}
+
+// VideoMetadata is the VideoDetails saved for each video along with the
+// metadata that is only needed to filter videos
+type VideoMetadata struct {
+	VideoDetails
+	LiveStatus   string
+	Availability string
+	Width        int
+	Height       int
+	Chapters     []Chapter
+	// DetailsUnavailable is set when only the availability of the video is
+	// known, such as for members-only videos fetched without cookies
+	DetailsUnavailable bool
+}
+
+// toVideoMetadata converts missing fields to NA which is what yt-dlp prints
+// for missing fields when printing them individually
+func (yd ytdlpVideoDetails) toVideoMetadata() VideoMetadata {
+	metadata := VideoMetadata{
+		VideoDetails: VideoDetails{
+			Id:         yd.Id,
+			Url:        yd.WebpageUrl,
+			Title:      yd.Title,
+			Channel:    yd.Channel,
+			UploadDate: "NA",
+			Duration:   "NA",
+		},
+		LiveStatus:   yd.LiveStatus,
+		Availability: yd.Availability,
+		Width:        yd.Width,
+		Height:       yd.Height,
+	}
+	if yd.UploadDate != nil {
+		metadata.UploadDate = *yd.UploadDate
+	}
+	if metadata.Channel == "" {
+		metadata.Channel = yd.Uploader
+	}
+	if yd.Duration != nil {
+		metadata.Duration = strconv.FormatFloat(*yd.Duration, 'f', -1, 64)
+	}
+	for _, chapter := range yd.Chapters {
+		metadata.Chapters = append(metadata.Chapters, Chapter{Title: chapter.Title, Start: chapter.StartTime, End: chapter.EndTime})
+	}
+	return metadata
+}
+
+// fetchVideoDetailsBatch fetches the details of all the videos with a single
+// yt-dlp process and calls onDetails for each video as soon as its details
+// are printed. Videos that yt-dlp is unable to fetch are skipped
+func fetchVideoDetailsBatch(ctx context.Context, videoRefs []VideoRef, stagePolicy *StagePolicy, onDetails func(VideoMetadata)) error {
+	batchCtx, cancel := stagePolicy.Context(ctx, "gather", "")
+	defer cancel()
+	// the whole batch can take hours for large channels so instead of a
+	// timeout for the batch, yt-dlp is only killed if it stops printing
+	// details for longer than the metadata timeout
+	stallTimeout := stagePolicy.Timeout("metadata", "")
+	var watchdog *time.Timer
+	if stallTimeout > 0 {
+		watchdog = time.AfterFunc(stallTimeout, cancel)
+		defer watchdog.Stop()
+	}
+
+	// the video urls are passed through stdin with -a - since there can be
+	// too many to pass as arguments
+	cmdFetch := newCommand(batchCtx, "yt-dlp", "--ignore-errors", "--no-warnings", "--print", videoDetailsTemplate, "-a", "-")
+	urls := make([]string, 0, len(videoRefs))
+	// yt-dlp prints the url it was given as original_url which is used to
+	// find the id the video is saved under
+	videoRefsByUrl := map[string]VideoRef{}
+	for _, videoRef := range videoRefs {
+		urls = append(urls, videoRef.Url)
+		videoRefsByUrl[videoRef.Url] = videoRef
+	}
+	cmdFetch.Stdin = strings.NewReader(strings.Join(urls, "\n"))
+	stdout, err := cmdFetch.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmdFetch.Start()
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(stdout)
+	for {
+		var details ytdlpVideoDetails
+		err = decoder.Decode(&details)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// read the rest of the output so that yt-dlp does not block
+			io.Copy(io.Discard, stdout)
+			break
+		}
+		if watchdog != nil {
+			watchdog.Reset(stallTimeout)
+		}
+		videoRef, ok := videoRefsByUrl[details.OriginalUrl]
+		if !ok {
+			continue
+		}
+		metadata := details.toVideoMetadata()
+		metadata.Id = videoRef.Id
+		if metadata.Url == "" {
+			metadata.Url = videoRef.Url
+		}
+		onDetails(metadata)
+	}
+
+	// yt-dlp exits with an error if any of the videos could not be fetched
+	// which is expected since those are fetched again one by one
+	waitErr := cmdFetch.Wait()
+	// the batch was interrupted rather than stalled when the parent context
+	// was cancelled
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if batchCtx.Err() != nil {
+		return fmt.Errorf("fetching video details stalled for %v: %w", stallTimeout, batchCtx.Err())
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if waitErr != nil {
+		slog.Warn(fmt.Sprintf("Unable to get metadata for some videos in batch: %s", waitErr.Error()))
+	}
+	return nil
+}
+
+// fetchVideoDetails fetches details for all the videos in one batch and
+// falls back to fetching the details of each video that the batch missed
+// separately, with up to maxWorkers videos at a time
+func fetchVideoDetails(ctx context.Context, videoRefs []VideoRef, maxWorkers int, stagePolicy *StagePolicy, onDetails func(VideoMetadata)) {
+	if len(videoRefs) == 0 {
+		return
+	}
+	slog.Info(fmt.Sprintf("Fetching details of %v videos", len(videoRefs)))
+	// local files are probed one by one with ffprobe instead
+	var batch []VideoRef
+	for _, videoRef := range videoRefs {
+		_, isLocal := localFilePath(videoRef.Url)
+		if !isLocal {
+			batch = append(batch, videoRef)
+		}
+	}
+	fetched := map[string]bool{}
+	var mu sync.Mutex
+	if len(batch) > 0 {
+		err := fetchVideoDetailsBatch(ctx, batch, stagePolicy, func(metadata VideoMetadata) {
+			mu.Lock()
+			fetched[metadata.Id] = true
+			mu.Unlock()
+			onDetails(metadata)
+		})
+		// the program is shutting down so the missed videos are not
+		// fetched one by one
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Unable to fetch video details in batch: %s", err.Error()))
+		}
+	}
+
+	var wg sync.WaitGroup
+	// limit number of goroutines running at the same time to avoid
+	// consuming too much cpu and ram
+	semaphore := make(chan struct{}, maxWorkers)
+	for _, videoRef := range videoRefs {
+		if fetched[videoRef.Id] {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			semaphore <- struct{}{}
+			defer wg.Done()
+			metadata, err := getVideoDetails(ctx, videoRef, stagePolicy)
+			<-semaphore
+			if err != nil {
+				return
+			}
+			onDetails(metadata)
+		}()
+	}
+	wg.Wait()
+}
+
+// parseVideoDetails parses a single line printed with videoDetailsTemplate
+func parseVideoDetails(data []byte) (VideoMetadata, error) {
+	var details ytdlpVideoDetails
+	err := json.Unmarshal(data, &details)
+	if err != nil {
+		return VideoMetadata{}, err
+	}
+	return details.toVideoMetadata(), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are always recorded but are only exposed when METRICS_ADDR is set
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ytms_queue_depth",
+		Help: "Number of videos waiting to be picked up by the workers of a stage.",
+	}, []string{"stage"})
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ytms_stage_duration_seconds",
+		Help: "Time taken to complete a stage for a video.",
+		// stages take from seconds to hours depending on the video
+		Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+	}, []string{"stage"})
+	stageFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ytms_stage_failures_total",
+		Help: "Number of times a stage failed for a video.",
+	}, []string{"stage", "reason"})
+	uploadBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ytms_upload_batch_size",
+		Help:    "Number of documents in each batch uploaded to Meilisearch.",
+		Buckets: prometheus.LinearBuckets(1, 1, 10),
+	})
+	uploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ytms_upload_duration_seconds",
+		Help:    "Time taken to upload a batch of documents to Meilisearch.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+	transcriptionRealTimeFactor = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "ytms_transcription_real_time_factor",
+		Help: "Time taken to transcribe a video divided by the duration of the video.",
+		// below 1 is faster than real time
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 5, 10},
+	})
+	transcriptIssues = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ytms_transcript_issues_total",
+		Help: "Number of transcripts found with each issue, whatever the quality action.",
+	}, []string{"issue"})
+)
+
+// videoStatusCollector reports the number of videos in each status from the
+// video data collection every time the metrics are scraped
+type videoStatusCollector struct {
+	safeVideoDataCollection *SafeVideoDataCollection
+	desc                    *prometheus.Desc
+}
+
+func newVideoStatusCollector(safeVideoDataCollection *SafeVideoDataCollection) *videoStatusCollector {
+	return &videoStatusCollector{
+		safeVideoDataCollection: safeVideoDataCollection,
+		desc:                    prometheus.NewDesc("ytms_videos", "Number of videos in each status.", []string{"status"}, nil),
+	}
+}
+
+func (vc *videoStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vc.desc
+}
+
+func (vc *videoStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	for status, count := range vc.safeVideoDataCollection.CountByStatus() {
+		ch <- prometheus.MustNewConstMetric(vc.desc, prometheus.GaugeValue, float64(count), status)
+	}
+}
+
+func serveMetrics(addr string, safeVideoDataCollection *SafeVideoDataCollection) {
+	prometheus.MustRegister(newVideoStatusCollector(safeVideoDataCollection))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	slog.Info(fmt.Sprintf("Serving metrics on %s/metrics", addr))
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to serve metrics: %s", err.Error()))
+	}
+}
+
+// enqueue sends the video to the queue of a stage while keeping track of the
+// number of videos waiting in the queue
+func enqueue(queue chan<- string, stage string, videoId string) {
+	queueDepth.WithLabelValues(stage).Inc()
+	queue <- videoId
+}
+
+// dequeued has to be called by the workers of a stage when they pick up a
+// video that was sent with enqueue
+func dequeued(stage string) {
+	queueDepth.WithLabelValues(stage).Dec()
+}
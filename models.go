@@ -1,6 +1,9 @@
 package main
 
-import "sync"
+import (
+	"maps"
+	"sync"
+)
 
 // when adding new fields, the gatherVideos and IndexWorker functions
 // have to be updated to assign values to the new fields
@@ -9,19 +12,104 @@ type VideoDetails struct {
 	Title      string `json:"title"`
 	UploadDate string `json:"uploadDate"`
 	Duration   string `json:"duration"`
+	// Url is the page of the video or file:// followed by the path for
+	// videos from local sources
+	Url string `json:"url,omitempty"`
+	// Description is only set for podcast episodes
+	Description string `json:"description,omitempty"`
+	// Channel is the name of the channel or uploader of the video
+	Channel string `json:"channel,omitempty"`
 }
 
 type Document struct {
+	// Transcript is the plain text of the transcript that is searched. The
+	// cues keep the timings of the text
 	Transcript string `json:"transcript"`
+	Cues       []Cue  `json:"cues"`
+	// TranscriptModel is the whisper model the transcript was made with
+	TranscriptModel   string `json:"transcriptModel,omitempty"`
+	TranscriptVersion int    `json:"transcriptVersion,omitempty"`
+	// Speakers are the labels of everyone who speaks in the video when
+	// diarization is enabled
+	Speakers []string `json:"speakers,omitempty"`
+	// Summary, Topics and Keywords are only set when enrichment is enabled
+	Summary  string   `json:"summary,omitempty"`
+	Topics   []string `json:"topics,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+	// Source, UploadDay and DurationSeconds are only used to filter
+	// searches. UploadDay is the upload date as a number such as 20240131
+	Source          string  `json:"source,omitempty"`
+	UploadDay       int     `json:"uploadDay,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	// Vectors are the embeddings of the document by embedder, only set
+	// when embeddings are computed by the tool
+	Vectors map[string][]float32 `json:"_vectors,omitempty"`
+	// Segments are uploaded to the segments index along with the document
+	Segments []SegmentDocument `json:"-"`
 	VideoDetails
 }
 
+// SegmentDocument is a part of a video, such as a chapter or a turn of a
+// speaker, that is indexed on its own so that search results lead to the
+// part of the video that matches
+type SegmentDocument struct {
+	// Id is the id of the video followed by the type and number of the
+	// segment
+	Id      string `json:"id"`
+	VideoId string `json:"videoId"`
+	Type    string `json:"type"`
+	// Speaker is only set for speaker segments and Chapter for chapter
+	// segments
+	Speaker    string  `json:"speaker,omitempty"`
+	Chapter    string  `json:"chapter,omitempty"`
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+	Text       string  `json:"text"`
+	Title      string  `json:"title"`
+	Url        string  `json:"url"`
+	UploadDate string  `json:"uploadDate"`
+	// Vectors are the embeddings of the segment by embedder
+	Vectors map[string][]float32 `json:"_vectors,omitempty"`
+}
+
 type VideoData struct {
 	Status  string `json:"status"`
 	ReIndex bool   `json:"reIndex"`
+	// Source is the url of the source the video was found in
+	Source string `json:"source,omitempty"`
+	// videos with a higher priority are downloaded and transcribed first
+	Priority int `json:"priority,omitempty"`
+	// MediaUrl is the audio file of podcast episodes which is downloaded
+	// directly instead of with yt-dlp
+	MediaUrl string `json:"mediaUrl,omitempty"`
+	// failures are reset once the video has been indexed
+	Failures    int    `json:"failures,omitempty"`
+	FailedStage string `json:"failedStage,omitempty"`
+	LastError   string `json:"lastError,omitempty"`
+	// reason the video was skipped by the filters of its source
+	SkipReason string `json:"skipReason,omitempty"`
+	// Quality is set once the video has been transcribed
+	Quality *TranscriptQuality `json:"quality,omitempty"`
+	// TranscriptVersion is the version of the current transcript. The
+	// files of previous versions are kept in transcripts/versions
+	TranscriptVersion          *TranscriptVersion  `json:"transcriptVersion,omitempty"`
+	PreviousTranscriptVersions []TranscriptVersion `json:"previousTranscriptVersions,omitempty"`
+	// Corrections are the replacements of the vocabulary that were made in
+	// the transcript when it was last indexed
+	Corrections []Correction `json:"corrections,omitempty"`
+	// Chapters are the chapters set by the creator of the video
+	Chapters []Chapter `json:"chapters,omitempty"`
 	VideoDetails
 }
 
+// Chapter is a section of a video. Start and End are in seconds from the
+// start of the video
+type Chapter struct {
+	Title string  `json:"title"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
 type VideoDataCollection map[string]VideoData
 
 type SafeVideoDataCollection struct {
@@ -41,3 +129,27 @@ func (sv *SafeVideoDataCollection) Write(videoId string, data VideoData) {
 	defer sv.mu.Unlock()
 	sv.videosDataAndStatus[videoId] = data
 }
+
+func (sv *SafeVideoDataCollection) CountByStatus() map[string]int {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	counts := map[string]int{}
+	for _, videoEntry := range sv.videosDataAndStatus {
+		counts[videoEntry.Status]++
+	}
+	return counts
+}
+
+func (sv *SafeVideoDataCollection) Delete(videoId string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	delete(sv.videosDataAndStatus, videoId)
+}
+
+// Copy returns a copy of the collection that can be read while videos are
+// being written to the collection
+func (sv *SafeVideoDataCollection) Copy() VideoDataCollection {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return maps.Clone(sv.videosDataAndStatus)
+}
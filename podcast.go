@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PodcastFeed struct {
+	Items []PodcastItem `xml:"channel>item"`
+}
+
+type PodcastItem struct {
+	Guid        string `xml:"guid"`
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+	Duration    string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+	Enclosure   struct {
+		Url  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"enclosure"`
+}
+
+// parsePodcastFeed reads the items of a podcast RSS feed
+func parsePodcastFeed(r io.Reader) ([]PodcastItem, error) {
+	var feed PodcastFeed
+	decoder := xml.NewDecoder(r)
+	// feeds that declare an encoding other than utf-8 are read as is
+	// instead of failing to parse
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	err := decoder.Decode(&feed)
+	if err != nil {
+		return nil, err
+	}
+	return feed.Items, nil
+}
+
+func fetchPodcastFeed(ctx context.Context, feedUrl string) ([]PodcastItem, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching podcast feed: %s", res.Status)
+	}
+	return parsePodcastFeed(res.Body)
+}
+
+// pubDate formats in the wild, RFC 1123 being the one required by RSS
+var podcastDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC3339,
+}
+
+// parsePodcastDate converts the pubDate of an item to the YYYYMMDD format
+// yt-dlp uses for upload dates
+func parsePodcastDate(pubDate string) string {
+	for _, layout := range podcastDateLayouts {
+		date, err := time.Parse(layout, strings.TrimSpace(pubDate))
+		if err == nil {
+			return date.Format("20060102")
+		}
+	}
+	return "NA"
+}
+
+// parsePodcastDuration converts an itunes:duration of seconds, MM:SS or
+// HH:MM:SS to seconds
+func parsePodcastDuration(duration string) string {
+	duration = strings.TrimSpace(duration)
+	if duration == "" {
+		return "NA"
+	}
+	var seconds int
+	for part := range strings.SplitSeq(duration, ":") {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return "NA"
+		}
+		seconds = seconds*60 + value
+	}
+	return strconv.Itoa(seconds)
+}
+
+// toVideoData converts a feed item to a video entry. The id is made from the
+// guid since enclosure urls of episodes can change when podcasts move hosts
+func (item PodcastItem) toVideoData(source Source) (VideoData, bool) {
+	guid := strings.TrimSpace(item.Guid)
+	if guid == "" {
+		guid = item.Enclosure.Url
+	}
+	if guid == "" || item.Enclosure.Url == "" {
+		return VideoData{}, false
+	}
+	pageUrl := strings.TrimSpace(item.Link)
+	if pageUrl == "" {
+		pageUrl = item.Enclosure.Url
+	}
+	return VideoData{
+		Source:   source.Url,
+		MediaUrl: item.Enclosure.Url,
+		VideoDetails: VideoDetails{
+			Id:          makeHashedVideoId("podcast", guid),
+			Title:       strings.TrimSpace(item.Title),
+			UploadDate:  parsePodcastDate(item.PubDate),
+			Duration:    parsePodcastDuration(item.Duration),
+			Url:         pageUrl,
+			Description: strings.TrimSpace(item.Description),
+		},
+	}, true
+}
+
+// gatherPodcastEpisodes adds the episodes of a podcast feed to the queue.
+// The feed already has all the details of each episode so nothing else has
+// to be fetched
+func gatherPodcastEpisodes(ctx context.Context, source Source, isUpdate bool, safeVideoDataCollection *SafeVideoDataCollection, stagePolicy *StagePolicy) error {
+	slog.Info(fmt.Sprintf("Checking podcast %s for new episodes", source.Url))
+	ctx, cancel := stagePolicy.Context(ctx, "metadata", "")
+	defer cancel()
+	items, err := fetchPodcastFeed(ctx, source.Url)
+	if err != nil {
+		return err
+	}
+
+	var countNew, countUpdated, countSkipped int
+	for _, item := range items {
+		episode, ok := item.toVideoData(source)
+		if !ok {
+			continue
+		}
+		videoEntry, exists := safeVideoDataCollection.Read(episode.Id)
+		if exists && !isUpdate && !(videoEntry.Status == "skipped" && recheckSkipReasons[videoEntry.SkipReason]) {
+			continue
+		}
+		// if the episode has already been recorded, update the details and
+		// set it to be re-indexed while preserving its original status
+		if exists && videoEntry.Status != "pending" && videoEntry.Status != "skipped" {
+			videoEntry.ReIndex = true
+			countUpdated++
+		} else {
+			videoEntry.ReIndex = false
+			if applyFilter(&videoEntry, VideoMetadata{VideoDetails: episode.VideoDetails}, source.Filter) {
+				countSkipped++
+			}
+			if !exists {
+				countNew++
+			}
+		}
+		videoEntry.Source = episode.Source
+		videoEntry.MediaUrl = episode.MediaUrl
+		videoEntry.VideoDetails = episode.VideoDetails
+		safeVideoDataCollection.Write(episode.Id, videoEntry)
+	}
+	slog.Info(fmt.Sprintf("%v new episodes have been added to the queue and are pending download, %v of them have been skipped by filters, %v episode details have been updated", countNew, countSkipped, countUpdated))
+	return nil
+}
+
+// downloadEnclosure downloads the audio file of a podcast episode over http
+// into the downloads directory so that it goes through the same steps as
+// videos downloaded by yt-dlp
+func downloadEnclosure(ctx context.Context, videoId string, mediaUrl string, outputPath string, progressTracker *ProgressTracker) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaUrl, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status downloading %s: %s", mediaUrl, res.Status)
+	}
+
+	outputFilePath := filepath.Join(outputPath, videoId+enclosureExtension(mediaUrl))
+	// the file is only renamed once complete so a partial download is never
+	// picked up by the process step
+	partFilePath := outputFilePath + ".part"
+	file, err := os.Create(partFilePath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, &progressReader{
+		reader:          res.Body,
+		total:           res.ContentLength,
+		videoId:         videoId,
+		progressTracker: progressTracker,
+	})
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partFilePath)
+		return err
+	}
+	return os.Rename(partFilePath, outputFilePath)
+}
+
+// enclosureExtension keeps the extension of the enclosure so that ffmpeg
+// gets a file name that matches its format, defaulting to .mp3
+func enclosureExtension(mediaUrl string) string {
+	parsedUrl, err := url.Parse(mediaUrl)
+	if err != nil {
+		return ".mp3"
+	}
+	ext := strings.ToLower(path.Ext(parsedUrl.Path))
+	for _, downloadExt := range downloadExtensions {
+		if ext == downloadExt {
+			return ext
+		}
+	}
+	return ".mp3"
+}
+
+// progressReader reports the progress of a download to the progress tracker
+type progressReader struct {
+	reader          io.Reader
+	read            int64
+	total           int64
+	videoId         string
+	progressTracker *ProgressTracker
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	pr.read += int64(n)
+	// the size is unknown when the server does not send a content length
+	if pr.total > 0 {
+		pr.progressTracker.Update(pr.videoId, float64(pr.read)/float64(pr.total)*100)
+	}
+	return n, err
+}
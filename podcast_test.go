@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePodcastFeed(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/podcast_feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := Source{Url: "https://podcast.example.com/feed.xml"}
+	tests := []struct {
+		name    string
+		input   string
+		want    []VideoData
+		wantErr bool
+	}{
+		{
+			// items without a link use the enclosure as the page url and
+			// items without an enclosure have nothing to transcribe
+			name:  "fixture",
+			input: string(fixture),
+			want: []VideoData{
+				{
+					Source:   source.Url,
+					MediaUrl: "https://cdn.example.com/episode-2.mp3",
+					VideoDetails: VideoDetails{
+						Id:          makeHashedVideoId("podcast", "episode-2"),
+						Title:       "Episode 2: Second",
+						UploadDate:  "20260908",
+						Duration:    "3723",
+						Url:         "https://podcast.example.com/episodes/2",
+						Description: "Notes for the second episode",
+					},
+				},
+				{
+					Source:   source.Url,
+					MediaUrl: "https://cdn.example.com/episode-1.mp3",
+					VideoDetails: VideoDetails{
+						Id:         makeHashedVideoId("podcast", "episode-1"),
+						Title:      "Episode 1: First",
+						UploadDate: "20260901",
+						Duration:   "1800",
+						Url:        "https://cdn.example.com/episode-1.mp3",
+					},
+				},
+			},
+		},
+		{
+			name:    "truncated",
+			input:   `<rss><channel><item><title>Cut off`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := parsePodcastFeed(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePodcastFeed error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []VideoData
+			for _, item := range items {
+				videoEntry, ok := item.toVideoData(source)
+				if ok {
+					got = append(got, videoEntry)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePodcastFeed = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePodcastDate(t *testing.T) {
+	tests := []struct {
+		pubDate string
+		want    string
+	}{
+		{"Tue, 08 Sep 2026 06:00:00 GMT", "20260908"},
+		{"Tue, 08 Sep 2026 06:00:00 +0000", "20260908"},
+		{"Tue, 8 Sep 2026 06:00:00 -0700", "20260908"},
+		{"Tue, 8 Sep 2026 06:00:00 EST", "20260908"},
+		{"8 Sep 2026 06:00:00 +0100", "20260908"},
+		{"  Tue, 08 Sep 2026 06:00:00 GMT\n", "20260908"},
+		{"2026-09-08T06:00:00Z", "20260908"},
+		{"08/09/2026", "NA"},
+		{"", "NA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pubDate, func(t *testing.T) {
+			got := parsePodcastDate(tt.pubDate)
+			if got != tt.want {
+				t.Errorf("parsePodcastDate(%q) = %q, want %q", tt.pubDate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePodcastDuration(t *testing.T) {
+	tests := []struct {
+		duration string
+		want     string
+	}{
+		{"01:02:03", "3723"},
+		{"1:02:03", "3723"},
+		{"62:03", "3723"},
+		{"05:30", "330"},
+		{"1800", "1800"},
+		{" 1800 ", "1800"},
+		{"0", "0"},
+		{"", "NA"},
+		{"1:xx", "NA"},
+		{"an hour", "NA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.duration, func(t *testing.T) {
+			got := parsePodcastDuration(tt.duration)
+			if got != tt.want {
+				t.Errorf("parsePodcastDuration(%q) = %q, want %q", tt.duration, got, tt.want)
+			}
+		})
+	}
+}
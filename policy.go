@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StagePolicy decides how long each stage of the pipeline is allowed to run
+// for a video and what happens to a video when a stage fails
+type StagePolicy struct {
+	// minTimeout is the timeout for short videos and for commands where the
+	// duration of the video is not known yet such as fetching metadata
+	minTimeout time.Duration
+	// the timeout of a stage is the duration of the video multiplied by the
+	// factor of the stage. A factor of 0 disables the timeout for the stage
+	timeoutFactors map[string]float64
+	// maxRetries is the number of times a video is retried in later runs
+	// before it is marked as failed. 0 retries the video indefinitely
+	maxRetries int
+	// running is the number of stages whose context has not been cancelled
+	// yet, which are waited for when the program is interrupted
+	running atomic.Int64
+}
+
+func NewStagePolicy(minTimeout time.Duration, downloadFactor float64, processFactor float64, transcribeFactor float64, maxRetries int) *StagePolicy {
+	return &StagePolicy{
+		minTimeout: minTimeout,
+		timeoutFactors: map[string]float64{
+			"download":   downloadFactor,
+			"process":    processFactor,
+			"transcribe": transcribeFactor,
+			// streaming runs all three stages at the same time so it gets
+			// the combined time of all of them
+			"stream": downloadFactor + processFactor + transcribeFactor,
+			// listing the videos of a source and fetching their details in
+			// a batch can take hours for large channels so they have no
+			// timeout
+			"gather": 0,
+		},
+		maxRetries: maxRetries,
+	}
+}
+
+// Timeout returns the time a stage is allowed to run for a video with the
+// given duration in seconds. 0 means there is no timeout
+func (sp *StagePolicy) Timeout(stage string, duration string) time.Duration {
+	if sp.minTimeout == 0 {
+		return 0
+	}
+	factor, ok := sp.timeoutFactors[stage]
+	if !ok {
+		return sp.minTimeout
+	}
+	if factor == 0 {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(duration, 64)
+	if err != nil {
+		// duration is NA for videos where yt-dlp could not find it such as
+		// live streams so there is nothing to scale the timeout by, but
+		// the stage still needs a timeout in case it never ends
+		return sp.minTimeout
+	}
+	return max(sp.minTimeout, time.Duration(seconds*factor*float64(time.Second)))
+}
+
+// Context returns a context that is cancelled when the stage has run for
+// longer than its timeout. The stage counts as running until the returned
+// cancel func is called, which callers do once its commands have exited
+func (sp *StagePolicy) Context(parent context.Context, stage string, duration string) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	timeout := sp.Timeout(stage, duration)
+	if timeout == 0 {
+		ctx, cancel = context.WithCancel(parent)
+	} else {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	}
+	sp.running.Add(1)
+	var once sync.Once
+	return ctx, func() {
+		cancel()
+		once.Do(func() { sp.running.Add(-1) })
+	}
+}
+
+// Wait waits for the running stages to return after their parent context
+// has been cancelled so that their commands are killed before the program
+// exits. It gives up after the timeout and returns false
+func (sp *StagePolicy) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for sp.running.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// Run runs a stage for a video with the timeout of the stage and records
+// the error on the video if the stage fails
+func (sp *StagePolicy) Run(ctx context.Context, stage string, videoId string, safeVideoDataCollection *SafeVideoDataCollection, run func(context.Context) error) error {
+	videoEntry, _ := safeVideoDataCollection.Read(videoId)
+	stageCtx, cancel := sp.Context(ctx, stage, videoEntry.Duration)
+	defer cancel()
+	start := time.Now()
+	err := run(stageCtx)
+	if err != nil {
+		sp.recordFailure(stageCtx, videoId, stage, err, safeVideoDataCollection)
+		return err
+	}
+	elapsed := time.Since(start)
+	stageDuration.WithLabelValues(stage).Observe(elapsed.Seconds())
+	seconds, parseErr := strconv.ParseFloat(videoEntry.Duration, 64)
+	// streaming includes the download and conversion which run at the same
+	// time as the transcription
+	if (stage == "transcribe" || stage == "stream") && parseErr == nil && seconds > 0 {
+		transcriptionRealTimeFactor.Observe(elapsed.Seconds() / seconds)
+	}
+	return nil
+}
+
+// recordFailure saves the error on the video so that it is retried in the
+// next run, or marks the video as failed once it has run out of retries
+func (sp *StagePolicy) recordFailure(ctx context.Context, videoId string, stage string, err error, safeVideoDataCollection *SafeVideoDataCollection) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// the program is shutting down, the video did not fail by itself
+		return
+	}
+	videoEntry, ok := safeVideoDataCollection.Read(videoId)
+	if !ok {
+		return
+	}
+	reason := "error"
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		reason = "timeout"
+		err = fmt.Errorf("timed out after %v", sp.Timeout(stage, videoEntry.Duration))
+		slog.Error(fmt.Sprintf("Video %s %s", videoId, err.Error()))
+	}
+	stageFailures.WithLabelValues(stage, reason).Inc()
+	videoEntry.Failures++
+	videoEntry.FailedStage = stage
+	videoEntry.LastError = err.Error()
+	if sp.maxRetries > 0 && videoEntry.Failures > sp.maxRetries {
+		slog.Warn(fmt.Sprintf("Video %s has failed %v times, marking as failed and skipping it", videoId, videoEntry.Failures))
+		videoEntry.Status = "failed"
+	}
+	safeVideoDataCollection.Write(videoId, videoEntry)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,7 +11,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/meilisearch/meilisearch-go"
@@ -20,6 +22,7 @@ func initDataDir(dataPath string) error {
 	downloadsPath := filepath.Join(dataPath, "downloads")
 	processedPath := filepath.Join(dataPath, "processed")
 	transcriptsPath := filepath.Join(dataPath, "transcripts")
+	enrichmentsPath := filepath.Join(dataPath, "enrichments")
 
 	// the logic for creating files and directories will be different
 	// because os.Mkdir and os.Create return errors differently in case
@@ -62,166 +65,211 @@ func initDataDir(dataPath string) error {
 	} else if err == nil {
 		slog.Info("transcripts directory not found, creating transcripts directory")
 	}
+	err = os.Mkdir(enrichmentsPath, 0750)
+	if err != nil && !os.IsExist(err) {
+		return err
+	} else if err == nil {
+		slog.Info("enrichments directory not found, creating enrichments directory")
+	}
 	return nil
 }
 
-func gatherVideos(url string, isUpdate bool, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int) error {
-	slog.Info("Checking channel for new videos")
-	cmdFetch := exec.Command("yt-dlp", "--flat-playlist", "--print", "%(id)s", url)
+func gatherVideos(ctx context.Context, source Source, isUpdate bool, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) error {
+	slog.Info(fmt.Sprintf("Checking channel %s for new videos", source.Url))
+	listCtx, cancel := stagePolicy.Context(ctx, "gather", "")
+	cmdFetch := newCommand(listCtx, "yt-dlp", "--flat-playlist", "--print", "%(id)s", source.Url)
 	out, err := cmdFetch.Output()
+	cancel()
 	outString := string(out)
 	if err != nil {
 		return errors.New(err.Error() + outString)
 	}
-	if isUpdate {
-		slog.Info("video details/metadata of all videos already in queue will be refetched and reindexed")
-		addAndUpdateVideosInQueue(outString, safeVideoDataCollection, maxWorkers)
-	} else {
-		addNewVideosToQueue(outString, safeVideoDataCollection, maxWorkers)
-	}
-	return nil
-}
-
-func addNewVideosToQueue(videosList string, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int) {
-	var wg sync.WaitGroup
-	// fetching video details for each video id is slow, hence fetch details
-	// for each video in parallel to speed up the process
-	// limit number of goroutines running at the same time to avoid
-	// consuming too much cpu and ram
-	semaphore := make(chan struct{}, maxWorkers)
-	var count int
-	for videoId := range strings.SplitSeq(videosList, "\n") {
+	var videoRefs []VideoRef
+	for videoId := range strings.SplitSeq(outString, "\n") {
 		if videoId == "" {
 			continue
 		}
+		videoRefs = append(videoRefs, VideoRef{Id: videoId, Url: youtubeVideoUrl(videoId)})
+	}
+	addVideosToQueue(ctx, videoRefs, source, isUpdate, safeVideoDataCollection, maxWorkers, stagePolicy)
+	return nil
+}
 
+func addNewVideosToQueue(ctx context.Context, videoRefs []VideoRef, source Source, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) {
+	var newVideoRefs []VideoRef
+	for _, videoRef := range videoRefs {
 		// if video details have already been recorded with metadata, skip
 		// entry.id will be blank if fetching metadata failed
-		videoEntry, ok := safeVideoDataCollection.Read(videoId)
-		if ok && videoEntry.Id != "" {
+		videoEntry, ok := safeVideoDataCollection.Read(videoRef.Id)
+		if ok && videoEntry.Id != "" && !(videoEntry.Status == "skipped" && recheckSkipReasons[videoEntry.SkipReason]) {
 			continue
 		}
-
-		wg.Add(1)
-		go func() {
-			semaphore <- struct{}{}
-			defer wg.Done()
-			videoDetails, err := getVideoDetails(videoId)
-			<-semaphore
-			if err != nil {
-				return
-			}
-			videoEntry.Status = "pending"
-			videoEntry.ReIndex = false
-			videoEntry.Title = videoDetails.Title
-			videoEntry.Id = videoDetails.Id
-			videoEntry.UploadDate = videoDetails.UploadDate
-			videoEntry.Duration = videoDetails.Duration
-			safeVideoDataCollection.Write(videoId, videoEntry)
-		}()
-
-		count++
+		newVideoRefs = append(newVideoRefs, videoRef)
 	}
-	wg.Wait()
-	slog.Info(fmt.Sprintf("%v new videos have been added to the queue and are pending download", count))
+
+	var countSkipped atomic.Int32
+	fetchVideoDetails(ctx, newVideoRefs, maxWorkers, stagePolicy, func(metadata VideoMetadata) {
+		videoEntry, _ := safeVideoDataCollection.Read(metadata.Id)
+		skipped := applyFilter(&videoEntry, metadata, source.Filter)
+		// videos without details are only saved when they are skipped,
+		// otherwise their details are fetched again in the next run
+		if metadata.DetailsUnavailable && !skipped {
+			return
+		}
+		videoEntry.ReIndex = false
+		videoEntry.Source = source.Url
+		videoEntry.VideoDetails = metadata.VideoDetails
+		videoEntry.Chapters = metadata.Chapters
+		if skipped {
+			countSkipped.Add(1)
+		}
+		safeVideoDataCollection.Write(metadata.Id, videoEntry)
+	})
+	slog.Info(fmt.Sprintf("%v new videos have been added to the queue and are pending download, %v of them have been skipped by filters", len(newVideoRefs), countSkipped.Load()))
 }
 
-func addAndUpdateVideosInQueue(videosList string, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int) {
-	var wg sync.WaitGroup
-	// fetching video details for each video id is slow, hence fetch details
-	// for each video in parallel to speed up the process
-	// limit number of goroutines running at the same time to avoid
-	// consuming too much cpu and ram
-	semaphore := make(chan struct{}, maxWorkers)
+func addAndUpdateVideosInQueue(ctx context.Context, videoRefs []VideoRef, source Source, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) {
 	var countNew int
 	var countUpdated int
-	for videoId := range strings.SplitSeq(videosList, "\n") {
-		if videoId == "" {
-			continue
-		}
-
-		videoEntry, ok := safeVideoDataCollection.Read(videoId)
-		// if video details have already been recorded, update the details
-		// and set it to be re-indexed while preserving its original status
-		wg.Add(1)
+	for _, videoRef := range videoRefs {
+		_, ok := safeVideoDataCollection.Read(videoRef.Id)
 		if ok {
-			go func() {
-				semaphore <- struct{}{}
-				defer wg.Done()
-				videoDetails, err := getVideoDetails(videoId)
-				<-semaphore
-				if err != nil {
-					return
-				}
-				videoEntry.ReIndex = true
-				videoEntry.Title = videoDetails.Title
-				videoEntry.Id = videoDetails.Id
-				videoEntry.UploadDate = videoDetails.UploadDate
-				videoEntry.Duration = videoDetails.Duration
-				safeVideoDataCollection.Write(videoId, videoEntry)
-			}()
 			countUpdated++
 		} else {
-			go func() {
-				semaphore <- struct{}{}
-				defer wg.Done()
-				videoDetails, err := getVideoDetails(videoId)
-				<-semaphore
-				if err != nil {
-					return
-				}
-				videoEntry.Status = "pending"
-				videoEntry.ReIndex = false
-				videoEntry.Title = videoDetails.Title
-				videoEntry.Id = videoDetails.Id
-				videoEntry.UploadDate = videoDetails.UploadDate
-				videoEntry.Duration = videoDetails.Duration
-				safeVideoDataCollection.Write(videoId, videoEntry)
-			}()
 			countNew++
 		}
-
 	}
-	wg.Wait()
+
+	fetchVideoDetails(ctx, videoRefs, maxWorkers, stagePolicy, func(metadata VideoMetadata) {
+		videoEntry, ok := safeVideoDataCollection.Read(metadata.Id)
+		// if video details have already been recorded, update the details
+		// and set it to be re-indexed while preserving its original status
+		// videos that have not been downloaded yet are filtered again in
+		// case the filters have changed
+		if ok && videoEntry.Status != "pending" && videoEntry.Status != "skipped" {
+			// the details that were saved before are kept
+			if metadata.DetailsUnavailable {
+				return
+			}
+			videoEntry.ReIndex = true
+		} else {
+			videoEntry.ReIndex = false
+			skipped := applyFilter(&videoEntry, metadata, source.Filter)
+			if metadata.DetailsUnavailable && !skipped {
+				return
+			}
+		}
+		videoEntry.Source = source.Url
+		videoEntry.VideoDetails = metadata.VideoDetails
+		videoEntry.Chapters = metadata.Chapters
+		safeVideoDataCollection.Write(metadata.Id, videoEntry)
+	})
 	slog.Info(fmt.Sprintf("%v new videos have been added to the queue and are pending download, %v video details have been updated", countNew, countUpdated))
 }
 
-func getVideoDetails(videoId string) (VideoDetails, error) {
-	videoUrl := "https://www.youtube.com/watch?v=" + videoId
-	// title has to be last because title has spaces within it and space is used as a separator to split this string
-	cmdFetch := exec.Command("yt-dlp", "--print", "%(upload_date)s %(duration)s %(title)s", videoUrl)
+// getVideoDetails fetches the details of a single video with yt-dlp, or with
+// ffprobe for local files
+func getVideoDetails(ctx context.Context, videoRef VideoRef, stagePolicy *StagePolicy) (VideoMetadata, error) {
+	_, isLocal := localFilePath(videoRef.Url)
+	if isLocal {
+		return probeLocalFile(ctx, videoRef, stagePolicy)
+	}
+	// the duration is not known before the metadata is fetched so the
+	// minimum timeout is used
+	ctx, cancel := stagePolicy.Context(ctx, "metadata", "")
+	defer cancel()
+	cmdFetch := newCommand(ctx, "yt-dlp", "--print", videoDetailsTemplate, videoRef.Url)
 	// Only capture stdout in out and do not capture stderr else stderr will end up
 	// in the video details in case of warnings
 	out, err := cmdFetch.Output()
-	outString := string(out)
-	outString = strings.TrimSuffix(outString, "\n")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && isMembersOnlyError(string(exitErr.Stderr)) {
+		// the details of members-only videos can not be fetched without
+		// cookies, so only the availability is passed on to the filters
+		slog.Warn(fmt.Sprintf("Unable to get metadata for %s: video is only available to channel members", videoRef.Id))
+		return VideoMetadata{
+			VideoDetails:       VideoDetails{Id: videoRef.Id, Url: videoRef.Url, UploadDate: "NA", Duration: "NA"},
+			Availability:       "subscriber_only",
+			DetailsUnavailable: true,
+		}, nil
+	}
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Unable to get metadata for %s: %s %s", videoRef.Id, err.Error(), string(out)))
+		return VideoMetadata{}, err
+	}
+	metadata, err := parseVideoDetails(out)
 	if err != nil {
-		slog.Warn(fmt.Sprintf("Unable to get metadata for %s: %s %s", videoId, err.Error(), outString))
-		return VideoDetails{}, err
+		slog.Warn(fmt.Sprintf("Unable to parse metadata for %s: %s", videoRef.Id, err.Error()))
+		return VideoMetadata{}, err
 	}
-	videoDetailsSlice := strings.SplitN(outString, " ", 3)
-	return VideoDetails{
-		Id:         videoId,
-		Title:      videoDetailsSlice[2],
-		UploadDate: videoDetailsSlice[0],
-		Duration:   videoDetailsSlice[1],
-	}, nil
+	// the id is taken from the request since the entry is saved under it
+	metadata.Id = videoRef.Id
+	if metadata.Url == "" {
+		metadata.Url = videoRef.Url
+	}
+	return metadata, nil
+}
+
+// isMembersOnlyError reports whether yt-dlp failed because the video is
+// only available to members of the channel
+func isMembersOnlyError(stderr string) bool {
+	return strings.Contains(stderr, "members-only") || strings.Contains(stderr, "available to this channel's members")
+}
 
+// applyFilter sets the video to pending if it passes the filter or skipped
+// with the reason it was filtered out. Returns true if the video is skipped
+func applyFilter(videoEntry *VideoData, metadata VideoMetadata, filter *VideoFilter) bool {
+	if videoEntry.Status == "skipped" && videoEntry.SkipReason == manualSkipReason {
+		return true
+	}
+	reason, description := filter.Evaluate(metadata)
+	if reason == "" {
+		videoEntry.Status = "pending"
+		videoEntry.SkipReason = ""
+		return false
+	}
+	slog.Info(fmt.Sprintf("Skipping video %s: %s", metadata.Id, description))
+	videoEntry.Status = "skipped"
+	videoEntry.SkipReason = reason
+	return true
 }
 
-func downloadVideo(videoId string, safeVideoDataCollection *SafeVideoDataCollection, ouputPath string) error {
+func downloadVideo(ctx context.Context, videoId string, safeVideoDataCollection *SafeVideoDataCollection, ouputPath string, progressTracker *ProgressTracker) error {
 	slog.Info(fmt.Sprintf("Downloading video %s", videoId))
-	videoUrl := "https://www.youtube.com/watch?v=" + videoId
+	videoEntry, ok := safeVideoDataCollection.Read(videoId)
+	if !ok {
+		return fmt.Errorf("Download Error: Unable to find job: %v in video data collection", videoId)
+	}
+	// podcast episodes are downloaded directly from the feed enclosure
+	if videoEntry.MediaUrl != "" {
+		progressTracker.Start(videoId, "Downloading")
+		err := downloadEnclosure(ctx, videoId, videoEntry.MediaUrl, ouputPath, progressTracker)
+		progressTracker.Finish(videoId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Unable to download video %s: %s", videoId, err.Error()))
+			return err
+		}
+		slog.Info(fmt.Sprintf("Downloaded video %s", videoId))
+		return setVideoStatus(videoId, "downloaded", safeVideoDataCollection)
+	}
 	// downloads audio only and saves it to the output path with name as videoId.mp3
-	cmdFetch := exec.Command("yt-dlp", "-x", "--audio-format", "mp3", "-P", ouputPath, "-o", "%(id)s.%(ext)s", videoUrl)
-	out, err := cmdFetch.CombinedOutput()
+	// the id is used as the file name instead of %(id)s because videos that
+	// are not from YouTube are saved under a different id than yt-dlp uses
+	// --newline prints each progress update on a new line so that it can be parsed
+	cmdFetch := newCommand(ctx, "yt-dlp", "--newline", "-x", "--audio-format", "mp3", "-P", ouputPath, "-o", videoId+".%(ext)s", videoUrl(videoEntry))
+	out := newProgressWriter(videoId, ytdlpProgressRegex, progressTracker)
+	cmdFetch.Stdout = out
+	cmdFetch.Stderr = out
+	progressTracker.Start(videoId, "Downloading")
+	err := cmdFetch.Run()
+	progressTracker.Finish(videoId)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Unable to download video %s: %s", videoId, err.Error()+string(out)))
+		slog.Error(fmt.Sprintf("Unable to download video %s: %s", videoId, err.Error()+out.String()))
 		return err
 	}
 
 	slog.Info(fmt.Sprintf("Downloaded video %s", videoId))
-	videoEntry, ok := safeVideoDataCollection.Read(videoId)
+	videoEntry, ok = safeVideoDataCollection.Read(videoId)
 	if !ok {
 		return fmt.Errorf("Download Error: Unable to find job: %v in video data collection", videoId)
 	}
@@ -231,10 +279,16 @@ func downloadVideo(videoId string, safeVideoDataCollection *SafeVideoDataCollect
 
 }
 
-func processVideo(videoId string, inputPath string, outputPath string, safeVideoDataCollection *SafeVideoDataCollection) error {
+func processVideo(ctx context.Context, videoId string, inputPath string, outputPath string, safeVideoDataCollection *SafeVideoDataCollection) error {
 	slog.Info(fmt.Sprintf("Processing video %s", videoId))
-	inputFilePath := filepath.Join(inputPath, fmt.Sprintf("%s.mp3", videoId))
+	inputFilePath, _ := downloadedFile(inputPath, videoId)
 	outputFilePath := filepath.Join(outputPath, fmt.Sprintf("%s.wav", videoId))
+	// local files are not downloaded and are converted from where they are
+	videoEntry, _ := safeVideoDataCollection.Read(videoId)
+	localPath, isLocal := localFilePath(videoEntry.Url)
+	if isLocal {
+		inputFilePath = localPath
+	}
 
 	_, err := os.Stat(outputFilePath)
 	if err == nil {
@@ -248,7 +302,7 @@ func processVideo(videoId string, inputPath string, outputPath string, safeVideo
 		return nil
 	}
 
-	cmdFetch := exec.Command("ffmpeg", "-i", inputFilePath, "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", outputFilePath)
+	cmdFetch := newCommand(ctx, "ffmpeg", "-i", inputFilePath, "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", outputFilePath)
 	out, err := cmdFetch.CombinedOutput()
 	if err != nil {
 		slog.Error(fmt.Sprintf("Unable to process video %s: %s", videoId, err.Error()+string(out)))
@@ -266,7 +320,7 @@ func processVideo(videoId string, inputPath string, outputPath string, safeVideo
 
 }
 
-func transcribeVideo(videoId string, inputPath string, outputPath string, modelPath string, safeVideoDataCollection *SafeVideoDataCollection) error {
+func transcribeVideo(ctx context.Context, videoId string, inputPath string, outputPath string, whisper *Whisper, safeVideoDataCollection *SafeVideoDataCollection, progressTracker *ProgressTracker) error {
 	slog.Info(fmt.Sprintf("Transcribing video %s", videoId))
 	inputFilePath := filepath.Join(inputPath, fmt.Sprintf("%s.wav", videoId))
 	outputFilePath := filepath.Join(outputPath, videoId)
@@ -280,13 +334,20 @@ func transcribeVideo(videoId string, inputPath string, outputPath string, modelP
 		}
 		videoEntry.Status = "transcribed"
 		safeVideoDataCollection.Write(videoId, videoEntry)
+		whisper.diarize(ctx, videoId, inputFilePath, outputPath)
 		return nil
 	}
 
-	cmdFetch := exec.Command("whisper-cli", "-osrt", "-m", modelPath, "-f", inputFilePath, "-of", outputFilePath)
-	out, err := cmdFetch.CombinedOutput()
+	videoEntry, _ := safeVideoDataCollection.Read(videoId)
+	cmdFetch := newCommand(ctx, "whisper-cli", whisper.Args(videoEntry, inputFilePath, outputFilePath)...)
+	out := newProgressWriter(videoId, whisperProgressRegex, progressTracker)
+	cmdFetch.Stdout = out
+	cmdFetch.Stderr = out
+	progressTracker.Start(videoId, "Transcribing")
+	err = cmdFetch.Run()
+	progressTracker.Finish(videoId)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Unable to transcribe video %s: %s", videoId, err.Error()+string(out)))
+		slog.Error(fmt.Sprintf("Unable to transcribe video %s: %s", videoId, err.Error()+out.String()))
 		return err
 	}
 
@@ -296,23 +357,180 @@ func transcribeVideo(videoId string, inputPath string, outputPath string, modelP
 		return fmt.Errorf("Transcribe Error: Unable to find job: %v in video data collection", videoId)
 	}
 	videoEntry.Status = "transcribed"
+	videoEntry.TranscriptVersion = whisper.Version(videoEntry)
+	safeVideoDataCollection.Write(videoId, videoEntry)
+	whisper.diarize(ctx, videoId, inputFilePath, outputPath)
+	return nil
+
+}
+
+// streamVideo pipes the audio from yt-dlp into ffmpeg and the converted wav
+// into whisper-cli so that no intermediate files are written to disk.
+// The status of the video is updated as each process in the pipeline exits
+// so the same transitions are recorded as when the files are written to disk
+func streamVideo(ctx context.Context, videoId string, outputPath string, whisper *Whisper, safeVideoDataCollection *SafeVideoDataCollection, progressTracker *ProgressTracker) error {
+	slog.Info(fmt.Sprintf("Streaming video %s", videoId))
+	videoEntry, ok := safeVideoDataCollection.Read(videoId)
+	if !ok {
+		return fmt.Errorf("Stream Error: Unable to find job: %v in video data collection", videoId)
+	}
+	outputFilePath := filepath.Join(outputPath, videoId)
+
+	// yt-dlp also streams the enclosure of podcast episodes since it
+	// supports direct links to audio files
+	fetchUrl := videoUrl(videoEntry)
+	if videoEntry.MediaUrl != "" {
+		fetchUrl = videoEntry.MediaUrl
+	}
+	cmdFetch := newCommand(ctx, "yt-dlp", "-q", "-f", "bestaudio", "-o", "-", fetchUrl)
+	cmdProcess := newCommand(ctx, "ffmpeg", "-loglevel", "error", "-i", "pipe:0", "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", "-f", "wav", "pipe:1")
+	// whisper-cli reads the audio from stdin when the file name is -
+	cmdTranscribe := newCommand(ctx, "whisper-cli", whisper.Args(videoEntry, "-", outputFilePath)...)
+
+	var fetchErrOut, processErrOut bytes.Buffer
+	cmdFetch.Stderr = &fetchErrOut
+	cmdProcess.Stderr = &processErrOut
+	// whisper-cli only starts transcribing after all of the audio has been
+	// streamed to it so the progress covers the transcription only
+	transcribeOut := newProgressWriter(videoId, whisperProgressRegex, progressTracker)
+	cmdTranscribe.Stdout = transcribeOut
+	cmdTranscribe.Stderr = transcribeOut
+	progressTracker.Start(videoId, "Streaming")
+	defer progressTracker.Finish(videoId)
+
+	var err error
+	cmdProcess.Stdin, err = cmdFetch.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmdTranscribe.Stdin, err = cmdProcess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	// start the pipeline from the end so that each process has a reader
+	// before the previous process starts writing to it
+	err = cmdTranscribe.Start()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to stream video %s: %s", videoId, err.Error()))
+		return err
+	}
+	err = cmdProcess.Start()
+	if err != nil {
+		cmdTranscribe.Process.Kill()
+		cmdTranscribe.Wait()
+		slog.Error(fmt.Sprintf("Unable to stream video %s: %s", videoId, err.Error()))
+		return err
+	}
+	err = cmdFetch.Start()
+	if err != nil {
+		cmdProcess.Process.Kill()
+		cmdTranscribe.Process.Kill()
+		cmdProcess.Wait()
+		cmdTranscribe.Wait()
+		slog.Error(fmt.Sprintf("Unable to stream video %s: %s", videoId, err.Error()))
+		return err
+	}
+
+	fetchErr := cmdFetch.Wait()
+	if fetchErr == nil {
+		slog.Info(fmt.Sprintf("Downloaded video %s", videoId))
+		setVideoStatus(videoId, "downloaded", safeVideoDataCollection)
+	}
+	processErr := cmdProcess.Wait()
+	if fetchErr == nil && processErr == nil {
+		slog.Info(fmt.Sprintf("Processed video %s", videoId))
+		setVideoStatus(videoId, "processed", safeVideoDataCollection)
+	}
+	transcribeErr := cmdTranscribe.Wait()
+
+	err = errors.Join(fetchErr, processErr, transcribeErr)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to stream video %s: %s", videoId, err.Error()+fetchErrOut.String()+processErrOut.String()+transcribeOut.String()))
+		// nothing from the pipeline was saved to disk so the video has to
+		// be streamed again from the start
+		setVideoStatus(videoId, "pending", safeVideoDataCollection)
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("Transcribed video %s", videoId))
+	videoEntry, ok = safeVideoDataCollection.Read(videoId)
+	if !ok {
+		return fmt.Errorf("Stream Error: Unable to find job: %v in video data collection", videoId)
+	}
+	videoEntry.Status = "transcribed"
+	videoEntry.TranscriptVersion = whisper.Version(videoEntry)
 	safeVideoDataCollection.Write(videoId, videoEntry)
+	// the audio is not saved when streaming so only tinydiarize can be used
+	whisper.diarize(ctx, videoId, "", outputPath)
 	return nil
+}
 
+// downloadExtensions are the extensions of files in the downloads directory.
+// yt-dlp converts downloads to mp3 but podcast enclosures are kept as is
+var downloadExtensions = []string{".mp3", ".m4a", ".aac", ".ogg", ".opus", ".webm", ".flac", ".wav"}
+
+// downloadedFile returns the path of the downloaded file of a video and
+// whether it exists, defaulting to the mp3 file name
+func downloadedFile(downloadsPath string, videoId string) (string, bool) {
+	for _, ext := range downloadExtensions {
+		filePath := filepath.Join(downloadsPath, videoId+ext)
+		if fileExists(filePath) {
+			return filePath, true
+		}
+	}
+	return filepath.Join(downloadsPath, videoId+".mp3"), false
+}
+
+// newCommand creates a command that is killed along with any processes it
+// spawned when the context is cancelled or times out
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	// do not wait indefinitely for output of killed processes
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
 }
 
-func uploadDocumentsToMeilisearch(documents []Document, searchClient meilisearch.ServiceManager, safeVideoDataCollection *SafeVideoDataCollection) {
+func setVideoStatus(videoId string, status string, safeVideoDataCollection *SafeVideoDataCollection) error {
+	videoEntry, ok := safeVideoDataCollection.Read(videoId)
+	if !ok {
+		return fmt.Errorf("Unable to find job: %v in video data collection", videoId)
+	}
+	videoEntry.Status = status
+	safeVideoDataCollection.Write(videoId, videoEntry)
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func uploadDocumentsToMeilisearch(documents []Document, searchClient meilisearch.ServiceManager, vectorizer *Vectorizer, safeVideoDataCollection *SafeVideoDataCollection) {
+	// keyword search still works for documents without embeddings
+	err := vectorizer.Add(documents)
+	if err != nil {
+		stageFailures.WithLabelValues("index", "embeddings").Inc()
+		slog.Error(fmt.Sprintf("Unable to compute embeddings, uploading documents without them: %s", err.Error()))
+	}
 	slog.Info(fmt.Sprintf("Uploading %v documents to search index", len(documents)))
-	_, err := searchClient.Index("videos").UpdateDocuments(documents)
+	uploadBatchSize.Observe(float64(len(documents)))
+	start := time.Now()
+	_, err = searchClient.Index("videos").UpdateDocuments(documents)
 	if err != nil {
+		uploadDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		stageFailures.WithLabelValues("index", "upload").Add(float64(len(documents)))
 		slog.Error(fmt.Sprintf("Unable to upload to index: %s", err.Error()))
 	} else {
+		uploadDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
 		ids := make([]string, 0, len(documents))
 
 		for _, doc := range documents {
 			ids = append(ids, doc.Id)
 		}
 		slog.Info(fmt.Sprintf("Uploaded %v documents to search index: %v", len(documents), ids))
+		uploadSegments(documents, ids, searchClient)
 		for _, document := range documents {
 			videoEntry, ok := safeVideoDataCollection.Read(document.Id)
 			if !ok {
@@ -320,14 +538,62 @@ func uploadDocumentsToMeilisearch(documents []Document, searchClient meilisearch
 			}
 			videoEntry.Status = "indexed"
 			videoEntry.ReIndex = false
+			videoEntry.Failures = 0
+			videoEntry.FailedStage = ""
+			videoEntry.LastError = ""
 			safeVideoDataCollection.Write(document.Id, videoEntry)
 
 		}
 	}
 }
 
+// uploadSegments replaces the segments of the videos in the segments index.
+// The old segments are deleted first since a new transcript can have fewer
+// segments
+func uploadSegments(documents []Document, ids []string, searchClient meilisearch.ServiceManager) {
+	var segments []SegmentDocument
+	for _, document := range documents {
+		segments = append(segments, document.Segments...)
+	}
+	_, err := searchClient.Index("segments").DeleteDocumentsByFilter(segmentsFilter(ids))
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to delete old segments from index: %s", err.Error()))
+		return
+	}
+	if len(segments) == 0 {
+		return
+	}
+	// the primary key has to be given since videoId could also be one
+	_, err = searchClient.Index("segments").AddDocuments(segments, "id")
+	if err != nil {
+		stageFailures.WithLabelValues("index", "segments").Inc()
+		slog.Error(fmt.Sprintf("Unable to upload segments to index: %s", err.Error()))
+		return
+	}
+	slog.Info(fmt.Sprintf("Uploaded %v segments to search index", len(segments)))
+}
+
+// segmentsFilter is the filter for the segments of videos. Video ids only
+// have letters, digits, - and _ so they do not have to be escaped
+func segmentsFilter(ids []string) string {
+	return fmt.Sprintf(`videoId IN ["%s"]`, strings.Join(ids, `", "`))
+}
+
+func loadProgress(projectPath string) (VideoDataCollection, error) {
+	videosJsonData, err := os.ReadFile(filepath.Join(projectPath, "videos.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read videos.json: %v", err.Error())
+	}
+	videoDataCollection := VideoDataCollection{}
+	err = json.Unmarshal(videosJsonData, &videoDataCollection)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshall videos.json: %v", err.Error())
+	}
+	return videoDataCollection, nil
+}
+
 func saveProgress(projectPath string, safeVideoDataCollection *SafeVideoDataCollection) {
-	updatedProgressData, err := json.MarshalIndent(safeVideoDataCollection.videosDataAndStatus, "", "\t")
+	updatedProgressData, err := json.MarshalIndent(safeVideoDataCollection.Copy(), "", "\t")
 	if err != nil {
 		slog.Error(fmt.Sprintf("Unable to marshall videos.json data: %v", err.Error()))
 		os.Exit(1)
@@ -340,100 +606,226 @@ func saveProgress(projectPath string, safeVideoDataCollection *SafeVideoDataColl
 	}
 }
 
-func downloadWorker(downloadQueue <-chan string, processQueue chan<- string, outputPath string, safeVideoDataCollection *SafeVideoDataCollection) {
+func downloadWorker(ctx context.Context, downloadQueue <-chan string, processQueue chan<- string, outputPath string, diskGuard *DiskGuard, stagePolicy *StagePolicy, progressTracker *ProgressTracker, safeVideoDataCollection *SafeVideoDataCollection, jobTracker *JobTracker) {
 	for job := range downloadQueue {
-		err := downloadVideo(job, safeVideoDataCollection, outputPath)
+		dequeued("download")
+		err := diskGuard.Wait(ctx, job)
 		if err != nil {
+			jobTracker.Done(job)
 			continue
 		}
-		processQueue <- job
+		err = stagePolicy.Run(ctx, "download", job, safeVideoDataCollection, func(ctx context.Context) error {
+			return downloadVideo(ctx, job, safeVideoDataCollection, outputPath, progressTracker)
+		})
+		if err != nil {
+			// the video will not reach the index worker
+			jobTracker.Done(job)
+			continue
+		}
+		enqueue(processQueue, "process", job)
 	}
 }
 
-func processWorker(processQueue <-chan string, transcribeQueue chan<- string, inputPath string, outputPath string, safeVideoDataCollection *SafeVideoDataCollection) {
+func processWorker(ctx context.Context, processQueue <-chan string, transcribeQueue chan<- string, inputPath string, outputPath string, stagePolicy *StagePolicy, safeVideoDataCollection *SafeVideoDataCollection, jobTracker *JobTracker) {
 	for job := range processQueue {
-		err := processVideo(job, inputPath, outputPath, safeVideoDataCollection)
+		dequeued("process")
+		err := stagePolicy.Run(ctx, "process", job, safeVideoDataCollection, func(ctx context.Context) error {
+			return processVideo(ctx, job, inputPath, outputPath, safeVideoDataCollection)
+		})
 		if err != nil {
+			jobTracker.Done(job)
 			continue
 		}
 		// remove file in previous step to save disk space
-		downloadedFileMp3 := filepath.Join(inputPath, fmt.Sprintf("%s.mp3", job))
-		downloadedFileM4a := filepath.Join(inputPath, fmt.Sprintf("%s.m4a", job))
-		downloadedFileWebm := filepath.Join(inputPath, fmt.Sprintf("%s.webm", job))
-		os.Remove(downloadedFileMp3)
-		os.Remove(downloadedFileM4a)
-		os.Remove(downloadedFileWebm)
-		transcribeQueue <- job
+		for _, ext := range downloadExtensions {
+			os.Remove(filepath.Join(inputPath, job+ext))
+		}
+		enqueue(transcribeQueue, "transcribe", job)
 	}
 }
 
-func transcribeWorker(transcribeQueue <-chan string, indexQueue chan<- string, inputPath string, outputPath string, modelPath string, safeVideoDataCollection *SafeVideoDataCollection) {
+// transcribeWorker sends transcribed videos to the next stage which is enrich
+// when enrichment is enabled and index otherwise
+func transcribeWorker(ctx context.Context, transcribeQueue <-chan string, nextQueue chan<- string, nextStage string, inputPath string, outputPath string, whisper *Whisper, stagePolicy *StagePolicy, qualityPolicy *QualityPolicy, progressTracker *ProgressTracker, safeVideoDataCollection *SafeVideoDataCollection, jobTracker *JobTracker) {
 	for job := range transcribeQueue {
-		err := transcribeVideo(job, inputPath, outputPath, modelPath, safeVideoDataCollection)
+		dequeued("transcribe")
+		err := reviewedTranscription(job, outputPath, qualityPolicy, safeVideoDataCollection, func() error {
+			return stagePolicy.Run(ctx, "transcribe", job, safeVideoDataCollection, func(ctx context.Context) error {
+				return transcribeVideo(ctx, job, inputPath, outputPath, whisper, safeVideoDataCollection, progressTracker)
+			})
+		})
 		if err != nil {
+			jobTracker.Done(job)
 			continue
 		}
 		// remove file in previous step to save disk space
 		processedFile := filepath.Join(inputPath, fmt.Sprintf("%s.wav", job))
 		os.Remove(processedFile)
-		indexQueue <- job
+		enqueueReviewed(nextQueue, nextStage, job, safeVideoDataCollection, jobTracker)
+	}
+}
+
+// reviewedTranscription runs a transcription and checks the quality of the
+// transcript, running the transcription once more when the quality policy
+// asks for the video to be transcribed again
+func reviewedTranscription(videoId string, transcriptsPath string, qualityPolicy *QualityPolicy, safeVideoDataCollection *SafeVideoDataCollection, transcribe func() error) error {
+	err := transcribe()
+	for err == nil && qualityPolicy.Review(videoId, transcriptsPath, safeVideoDataCollection) == qualityActionRetranscribe {
+		err = transcribe()
+	}
+	return err
+}
+
+// enqueueReviewed sends a transcribed video to the next stage unless its
+// transcript was quarantined
+func enqueueReviewed(nextQueue chan<- string, nextStage string, videoId string, safeVideoDataCollection *SafeVideoDataCollection, jobTracker *JobTracker) {
+	videoEntry, _ := safeVideoDataCollection.Read(videoId)
+	if videoEntry.Status == "quarantined" {
+		jobTracker.Done(videoId)
+		return
+	}
+	enqueue(nextQueue, nextStage, videoId)
+}
+
+// streamWorker takes the place of the transcribe worker in streaming mode so
+// that the number of whisper-cli processes running at the same time is still
+// limited by the number of transcribe workers. Videos that were processed
+// before streaming mode was enabled are picked up from the transcribe queue
+// and are preferred over streaming new videos
+func streamWorker(ctx context.Context, streamQueue <-chan string, transcribeQueue <-chan string, nextQueue chan<- string, nextStage string, processedPath string, outputPath string, whisper *Whisper, stagePolicy *StagePolicy, qualityPolicy *QualityPolicy, progressTracker *ProgressTracker, safeVideoDataCollection *SafeVideoDataCollection, jobTracker *JobTracker) {
+	stream := func(job string) {
+		dequeued("stream")
+		err := reviewedTranscription(job, outputPath, qualityPolicy, safeVideoDataCollection, func() error {
+			return stagePolicy.Run(ctx, "stream", job, safeVideoDataCollection, func(ctx context.Context) error {
+				return streamVideo(ctx, job, outputPath, whisper, safeVideoDataCollection, progressTracker)
+			})
+		})
+		if err != nil {
+			jobTracker.Done(job)
+			return
+		}
+		enqueueReviewed(nextQueue, nextStage, job, safeVideoDataCollection, jobTracker)
+	}
+	transcribe := func(job string) {
+		dequeued("transcribe")
+		err := reviewedTranscription(job, outputPath, qualityPolicy, safeVideoDataCollection, func() error {
+			return stagePolicy.Run(ctx, "transcribe", job, safeVideoDataCollection, func(ctx context.Context) error {
+				return transcribeVideo(ctx, job, processedPath, outputPath, whisper, safeVideoDataCollection, progressTracker)
+			})
+		})
+		if err != nil {
+			jobTracker.Done(job)
+			return
+		}
+		processedFile := filepath.Join(processedPath, fmt.Sprintf("%s.wav", job))
+		os.Remove(processedFile)
+		enqueueReviewed(nextQueue, nextStage, job, safeVideoDataCollection, jobTracker)
+	}
+	for {
+		select {
+		case job := <-transcribeQueue:
+			transcribe(job)
+			continue
+		default:
+		}
+		select {
+		case job := <-streamQueue:
+			stream(job)
+		case job := <-transcribeQueue:
+			transcribe(job)
+		}
+	}
+}
+
+// enrichWorker sends the transcripts of videos to the language model before
+// they are indexed. Enrichment only adds to the document so videos are
+// indexed without it when it fails
+func enrichWorker(ctx context.Context, enrichQueue <-chan string, indexQueue chan<- string, transcriptsPath string, enricher *Enricher, vocabulary *Vocabulary, stagePolicy *StagePolicy, safeVideoDataCollection *SafeVideoDataCollection) {
+	for job := range enrichQueue {
+		dequeued("enrich")
+		err := enrichVideo(ctx, job, transcriptsPath, enricher, vocabulary, stagePolicy, safeVideoDataCollection)
+		if err != nil {
+			if ctx.Err() == nil {
+				stageFailures.WithLabelValues("enrich", "error").Inc()
+			}
+			slog.Error(fmt.Sprintf("Unable to enrich video %s, indexing it without a summary: %s", job, err.Error()))
+		}
+		enqueue(indexQueue, "index", job)
 	}
 }
 
-func indexWorker(indexQueue <-chan string, transcriptsPath string, searchClient meilisearch.ServiceManager, safeVideoDataCollection *SafeVideoDataCollection, wg *sync.WaitGroup) {
+func enrichVideo(ctx context.Context, videoId string, transcriptsPath string, enricher *Enricher, vocabulary *Vocabulary, stagePolicy *StagePolicy, safeVideoDataCollection *SafeVideoDataCollection) error {
+	videoEntry, ok := safeVideoDataCollection.Read(videoId)
+	if !ok {
+		return fmt.Errorf("Enrich Error: Unable to find job: %v in video data collection", videoId)
+	}
+	_, cues, err := readTranscript(filepath.Join(transcriptsPath, fmt.Sprintf("%s.srt", videoId)))
+	if err != nil {
+		return err
+	}
+	// the model is given the same text that is indexed
+	vocabulary.Apply(videoEntry.Source, cues)
+	ctx, cancel := stagePolicy.Context(ctx, "enrich", "")
+	defer cancel()
+	start := time.Now()
+	err = enricher.Enrich(ctx, videoEntry, transcriptText(cues))
+	if err != nil {
+		return err
+	}
+	stageDuration.WithLabelValues("enrich").Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// higher batch sizes causes meilisearch to return 413 error
+// reduce this value if facing 413 errors
+const maxIndexBatchSize = 5
+
+func indexWorker(indexQueue <-chan string, transcriptsPath string, enrichmentsPath string, vocabulary *Vocabulary, searchClient meilisearch.ServiceManager, vectorizer *Vectorizer, safeVideoDataCollection *SafeVideoDataCollection, jobTracker *JobTracker) {
 	// upload video documents to meilisearch every second in batch to avoid
 	// sending too many requests to meilisearch instance
 	// batch uploading is recommended by meilisearch instead of uploading
 	// documents one by one
 	limiter := time.Tick(1 * time.Second)
-	// higher batch sizes causes meilisearch to return 413 error
-	// reduce this value if facing 413 errors
-	maxBatchSize := 5
 	var documents []Document
 	for {
 		select {
 		case job := <-indexQueue:
+			dequeued("index")
 			videoEntry, ok := safeVideoDataCollection.Read(job)
 			if !ok {
 				slog.Error(fmt.Sprintf("Index Error: Unable to find job: %v in video data collection", job))
-				wg.Done()
-				continue
-			}
-			transcriptFilePath := filepath.Join(transcriptsPath, fmt.Sprintf("%s.srt", job))
-			transcriptBytes, err := os.ReadFile(transcriptFilePath)
-			if err != nil {
-				slog.Error(fmt.Sprintf("Unable to read srt file: %s", err.Error()))
-				wg.Done()
+				jobTracker.Done(job)
 				continue
 			}
-			document := Document{
-				Transcript: string(transcriptBytes),
-			}
 			if videoEntry.Id == "" {
 				slog.Error(fmt.Sprintf("Video metadata not available for: %s. Setting to reindex", job))
+				stageFailures.WithLabelValues("index", "missing_metadata").Inc()
 				videoEntry.ReIndex = true
 				safeVideoDataCollection.Write(job, videoEntry)
-				wg.Done()
+				jobTracker.Done(job)
+				continue
+			}
+			document, err := buildDocument(transcriptsPath, enrichmentsPath, videoEntry, vocabulary, safeVideoDataCollection)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Unable to read srt file: %s", err.Error()))
+				stageFailures.WithLabelValues("index", "missing_transcript").Inc()
+				jobTracker.Done(job)
 				continue
 			}
-			document.Id = videoEntry.Id
-			document.Title = videoEntry.Title
-			document.UploadDate = videoEntry.UploadDate
-			document.Duration = videoEntry.Duration
 			documents = append(documents, document)
 		case <-limiter:
 			if len(documents) == 0 {
 				continue
 			}
 			// limit max number of documents in a batch
-			batchSize := min(maxBatchSize, len(documents))
+			batchSize := min(maxIndexBatchSize, len(documents))
 			uploadBatch := documents[:batchSize]
-			uploadDocumentsToMeilisearch(uploadBatch, searchClient, safeVideoDataCollection)
-			// only call wg.Done() on the last step
+			uploadDocumentsToMeilisearch(uploadBatch, searchClient, vectorizer, safeVideoDataCollection)
+			// only call jobTracker.Done() on the last step
 			// because all of the jobs that have completed the last step
 			// will be the sum of all the jobs input to all the pipelines
-			for range batchSize {
-				wg.Done()
+			for _, document := range uploadBatch {
+				jobTracker.Done(document.Id)
 			}
 			// remaining unuploaded documents that will be handled
 			// at next time tick
@@ -442,16 +834,20 @@ func indexWorker(indexQueue <-chan string, transcriptsPath string, searchClient
 	}
 }
 
-func printSummary(safeVideoDataCollection *SafeVideoDataCollection, maxDownloadAndProcessWorkers int, maxVideoDetailFetchWorkers int, maxTranscribeWorkers int) {
-	countTotal := len(safeVideoDataCollection.videosDataAndStatus)
+func printSummary(safeVideoDataCollection *SafeVideoDataCollection, maxDownloadAndProcessWorkers int, maxVideoDetailFetchWorkers int, maxTranscribeWorkers int, diskGuard *DiskGuard) {
+	videoDataCollection := safeVideoDataCollection.Copy()
+	countTotal := len(videoDataCollection)
 	var countPending int
 	var countDownloaded int
 	var countProcessed int
 	var countTranscribed int
 	var countIndexed int
 	var countReindex int
+	var countFailed int
+	var countSkipped int
+	var countQuarantined int
 
-	for _, video := range safeVideoDataCollection.videosDataAndStatus {
+	for _, video := range videoDataCollection {
 		switch video.Status {
 		case "pending":
 			countPending++
@@ -463,6 +859,12 @@ func printSummary(safeVideoDataCollection *SafeVideoDataCollection, maxDownloadA
 			countTranscribed++
 		case "indexed":
 			countIndexed++
+		case "failed":
+			countFailed++
+		case "skipped":
+			countSkipped++
+		case "quarantined":
+			countQuarantined++
 		default:
 
 		}
@@ -472,6 +874,19 @@ func printSummary(safeVideoDataCollection *SafeVideoDataCollection, maxDownloadA
 		}
 	}
 
+	// disk usage is only informational so errors are shown in the summary
+	// instead of stopping the program
+	backlog := "unavailable"
+	backlogFiles, backlogBytes, err := diskGuard.Backlog()
+	if err == nil {
+		backlog = fmt.Sprintf("%v files (%v MB)", backlogFiles, backlogBytes/bytesPerMB)
+	}
+	free := "unavailable"
+	freeBytes, err := diskGuard.FreeSpace()
+	if err == nil {
+		free = fmt.Sprintf("%v MB", freeBytes/bytesPerMB)
+	}
+
 	slog.Info(fmt.Sprintf(`========== Summary: ==========
 
 Enqueued a total of %v videos
@@ -482,6 +897,12 @@ Pending Processing: %v
 Pending Transcribing: %v
 Pending Indexing: %v
 Pending Re-Indexing: %v
+Failed: %v
+Skipped by filters: %v
+Quarantined: %v
+
+Backlog on disk: %v
+Free disk space: %v
 
 Max Download/Process Workers: %v
 Max Video Fetch Workers: %v
@@ -496,6 +917,11 @@ Max Transcribe Workers: %v
 		countProcessed,
 		countTranscribed,
 		countReindex,
+		countFailed,
+		countSkipped,
+		countQuarantined,
+		backlog,
+		free,
 		maxDownloadAndProcessWorkers,
 		maxVideoDetailFetchWorkers,
 		maxTranscribeWorkers,
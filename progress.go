@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Progress struct {
+	VideoId   string    `json:"videoId"`
+	Stage     string    `json:"stage"`
+	Percent   float64   `json:"percent"`
+	StartedAt time.Time `json:"startedAt"`
+	// the last 10% step that was logged to avoid flooding the logs
+	loggedStep int
+}
+
+// ETA estimates the remaining time assuming the rest of the stage runs at
+// the same speed as the part that has completed
+func (p Progress) ETA() (time.Duration, bool) {
+	if p.Percent <= 0 {
+		return 0, false
+	}
+	elapsed := time.Since(p.StartedAt)
+	remaining := time.Duration(float64(elapsed) * (100 - p.Percent) / p.Percent)
+	return remaining.Round(time.Second), true
+}
+
+func (p Progress) String() string {
+	eta, ok := p.ETA()
+	if !ok {
+		return fmt.Sprintf("%s %s: started %v ago", p.Stage, p.VideoId, time.Since(p.StartedAt).Round(time.Second))
+	}
+	return fmt.Sprintf("%s %s: %.1f%%, ETA %v", p.Stage, p.VideoId, p.Percent, eta)
+}
+
+// ProgressTracker keeps the progress of the videos that are currently being
+// downloaded or transcribed
+type ProgressTracker struct {
+	inProgress map[string]*Progress
+	mu         sync.Mutex
+}
+
+func NewProgressTracker() *ProgressTracker {
+	return &ProgressTracker{
+		inProgress: map[string]*Progress{},
+	}
+}
+
+func (pt *ProgressTracker) Start(videoId string, stage string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.inProgress[videoId] = &Progress{
+		VideoId:   videoId,
+		Stage:     stage,
+		StartedAt: time.Now(),
+	}
+}
+
+func (pt *ProgressTracker) Update(videoId string, percent float64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	progress, ok := pt.inProgress[videoId]
+	if !ok {
+		return
+	}
+	progress.Percent = percent
+	step := int(percent / 10)
+	if step > progress.loggedStep {
+		progress.loggedStep = step
+		slog.Info(progress.String())
+	}
+}
+
+func (pt *ProgressTracker) Finish(videoId string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	delete(pt.inProgress, videoId)
+}
+
+// Snapshot returns the progress of all videos in progress sorted by the
+// time they were started
+func (pt *ProgressTracker) Snapshot() []Progress {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	snapshot := make([]Progress, 0, len(pt.inProgress))
+	for _, progress := range pt.inProgress {
+		snapshot = append(snapshot, *progress)
+	}
+	slices.SortFunc(snapshot, func(a, b Progress) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+	return snapshot
+}
+
+// LogStatus logs the progress of all videos in progress at every interval
+func (pt *ProgressTracker) LogStatus(interval time.Duration) {
+	for range time.Tick(interval) {
+		snapshot := pt.Snapshot()
+		if len(snapshot) == 0 {
+			continue
+		}
+		lines := make([]string, 0, len(snapshot))
+		for _, progress := range snapshot {
+			lines = append(lines, progress.String())
+		}
+		slog.Info(fmt.Sprintf("========== In Progress: ==========\n\n%s\n", strings.Join(lines, "\n")))
+	}
+}
+
+// progressFileInterval is how often the progress of the videos in progress
+// is saved to progress.json
+const progressFileInterval = 5 * time.Second
+
+// ProgressFile is saved in progress.json in DATA_PATH while the pipeline is
+// running so that the status command can show the videos in progress
+type ProgressFile struct {
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	InProgress []Progress `json:"inProgress"`
+}
+
+func progressFilePath(dataPath string) string {
+	return filepath.Join(dataPath, "progress.json")
+}
+
+// SaveStatus saves the progress of all videos in progress at every interval
+func (pt *ProgressTracker) SaveStatus(dataPath string, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := pt.save(dataPath)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Unable to save progress.json: %s", err.Error()))
+		}
+	}
+}
+
+func (pt *ProgressTracker) save(dataPath string) error {
+	data, err := json.MarshalIndent(ProgressFile{UpdatedAt: time.Now(), InProgress: pt.Snapshot()}, "", "\t")
+	if err != nil {
+		return err
+	}
+	// the file is replaced in one go so that status never reads half of it
+	tmpPath := progressFilePath(dataPath) + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, progressFilePath(dataPath))
+}
+
+// removeProgressFile removes progress.json when the pipeline stops
+func removeProgressFile(dataPath string) {
+	err := os.Remove(progressFilePath(dataPath))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn(fmt.Sprintf("Unable to remove progress.json: %s", err.Error()))
+	}
+}
+
+// readProgressFile returns the videos in progress in a running pipeline.
+// progress.json is ignored when it has not been updated for a while since
+// the pipeline may have been killed before it could remove it
+func readProgressFile(dataPath string) ([]Progress, error) {
+	data, err := os.ReadFile(progressFilePath(dataPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var progressFile ProgressFile
+	err = json.Unmarshal(data, &progressFile)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(progressFile.UpdatedAt) > 3*progressFileInterval {
+		return nil, nil
+	}
+	return progressFile.InProgress, nil
+}
+
+// yt-dlp prints lines such as
+// [download]  45.3% of   3.45MiB at    1.20MiB/s ETA 00:02
+// when run with --newline
+var ytdlpProgressRegex = regexp.MustCompile(`^\[download\]\s+(\d+(?:\.\d+)?)%`)
+
+// whisper-cli prints lines such as
+// whisper_print_progress_callback: progress =  25%
+// when run with --print-progress
+var whisperProgressRegex = regexp.MustCompile(`progress\s*=\s*(\d+(?:\.\d+)?)%`)
+
+func parseProgress(regex *regexp.Regexp, line string) (float64, bool) {
+	match := regex.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+	percent, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return percent, true
+}
+
+// progressWriter collects the output of a command like
+// exec.Cmd.CombinedOutput while reporting progress as the command prints it
+type progressWriter struct {
+	videoId         string
+	regex           *regexp.Regexp
+	progressTracker *ProgressTracker
+	out             bytes.Buffer
+	// part of a line that has not been terminated yet
+	pending []byte
+}
+
+func newProgressWriter(videoId string, regex *regexp.Regexp, progressTracker *ProgressTracker) *progressWriter {
+	return &progressWriter{
+		videoId:         videoId,
+		regex:           regex,
+		progressTracker: progressTracker,
+	}
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.out.Write(p)
+	pw.pending = append(pw.pending, p...)
+	for {
+		// progress bars are redrawn with \r so lines have to be split on
+		// \r as well as \n
+		i := bytes.IndexAny(pw.pending, "\r\n")
+		if i < 0 {
+			break
+		}
+		percent, ok := parseProgress(pw.regex, string(pw.pending[:i]))
+		if ok {
+			pw.progressTracker.Update(pw.videoId, percent)
+		}
+		pw.pending = pw.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+func (pw *progressWriter) String() string {
+	return pw.out.String()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// what happens to a transcript that has quality issues
+const (
+	qualityActionIndex        = "index"
+	qualityActionQuarantine   = "quarantine"
+	qualityActionRetranscribe = "retranscribe"
+)
+
+var qualityActions = map[string]bool{qualityActionIndex: true, qualityActionQuarantine: true, qualityActionRetranscribe: true}
+
+// issues found in transcripts
+const (
+	qualityIssueEmpty       = "empty"
+	qualityIssueRepetition  = "repetition"
+	qualityIssueLowWordRate = "low_words_per_minute"
+)
+
+// repetitionLookbackCues is the number of cues before a cue that are
+// checked for the same text
+const repetitionLookbackCues = 3
+
+// minDurationForWordRate is the duration in seconds below which the word
+// rate of a video is not checked
+const minDurationForWordRate = 60
+
+type TranscriptQuality struct {
+	// Score is between 0 and 1 where 1 has no issues
+	Score  float64  `json:"score"`
+	Issues []string `json:"issues,omitempty"`
+	// RepeatedShare is the share of cues that repeat one of the cues just
+	// before them
+	RepeatedShare  float64 `json:"repeatedShare"`
+	WordsPerMinute float64 `json:"wordsPerMinute,omitempty"`
+	// Retranscribed is set once the video has been transcribed again with
+	// the alternate settings
+	Retranscribed bool `json:"retranscribed,omitempty"`
+}
+
+// QualityPolicy checks transcripts for whisper hallucinations before they
+// are indexed. Whisper tends to repeat the same line over and over or emit
+// nothing at all for videos without speech
+type QualityPolicy struct {
+	action            string
+	minWordsPerMinute float64
+	maxRepeatedShare  float64
+	// retranscribeModelPath and retranscribeArgs are used to transcribe a
+	// video again when its transcript has issues
+	retranscribeModelPath string
+	retranscribeArgs      []string
+}
+
+func NewQualityPolicy(action string, minWordsPerMinute float64, maxRepeatedShare float64, retranscribeModelPath string, retranscribeArgs []string) *QualityPolicy {
+	return &QualityPolicy{
+		action:                action,
+		minWordsPerMinute:     minWordsPerMinute,
+		maxRepeatedShare:      maxRepeatedShare,
+		retranscribeModelPath: retranscribeModelPath,
+		retranscribeArgs:      retranscribeArgs,
+	}
+}
+
+// Analyze scores the cues of a transcript for a video with the given
+// duration in seconds
+func (qp *QualityPolicy) Analyze(cues []Cue, duration string) TranscriptQuality {
+	var quality TranscriptQuality
+	words := len(strings.Fields(transcriptText(cues)))
+	if words == 0 {
+		quality.Issues = append(quality.Issues, qualityIssueEmpty)
+		return quality
+	}
+
+	// loops of two or three alternating lines are as common as a single
+	// line being repeated so each cue is compared to a few cues before it
+	var spoken []string
+	for _, cue := range cues {
+		text := normalizeCueText(cue.Text)
+		if text != "" && !annotationPattern.MatchString(cue.Text) {
+			spoken = append(spoken, text)
+		}
+	}
+	var repeated int
+	for i, text := range spoken {
+		for j := max(0, i-repetitionLookbackCues); j < i; j++ {
+			if spoken[j] == text {
+				repeated++
+				break
+			}
+		}
+	}
+	quality.RepeatedShare = roundScore(float64(repeated) / float64(len(spoken)))
+	quality.Score = 1 - quality.RepeatedShare
+	if quality.RepeatedShare > qp.maxRepeatedShare {
+		quality.Issues = append(quality.Issues, qualityIssueRepetition)
+	}
+
+	// the word rate of short videos is too noisy to judge
+	seconds, err := strconv.ParseFloat(duration, 64)
+	if err == nil && seconds >= minDurationForWordRate {
+		quality.WordsPerMinute = roundScore(float64(words) / (seconds / 60))
+		if qp.minWordsPerMinute > 0 {
+			quality.Score *= min(1, quality.WordsPerMinute/qp.minWordsPerMinute)
+			if quality.WordsPerMinute < qp.minWordsPerMinute {
+				quality.Issues = append(quality.Issues, qualityIssueLowWordRate)
+			}
+		}
+	}
+	quality.Score = roundScore(quality.Score)
+	return quality
+}
+
+// Review analyzes the transcript of a video that has just been transcribed,
+// records the quality on the video and returns the action to take. When the
+// transcript has to be transcribed again, the status of the video is set
+// back so that the caller can run the transcription again
+func (qp *QualityPolicy) Review(videoId string, transcriptsPath string, safeVideoDataCollection *SafeVideoDataCollection) string {
+	videoEntry, ok := safeVideoDataCollection.Read(videoId)
+	if !ok {
+		return qualityActionIndex
+	}
+	transcriptFilePath := filepath.Join(transcriptsPath, fmt.Sprintf("%s.srt", videoId))
+	_, cues, err := readTranscript(transcriptFilePath)
+	if err != nil {
+		// the index stage reports transcripts that cannot be read
+		return qualityActionIndex
+	}
+	quality := qp.Analyze(cues, videoEntry.Duration)
+	quality.Retranscribed = videoEntry.Quality != nil && videoEntry.Quality.Retranscribed
+	videoEntry.Quality = &quality
+	for _, issue := range quality.Issues {
+		transcriptIssues.WithLabelValues(issue).Inc()
+	}
+	if len(quality.Issues) == 0 || qp.action == qualityActionIndex {
+		if len(quality.Issues) > 0 {
+			slog.Warn(fmt.Sprintf("Transcript of %s has issues: %s (score %v), indexing it anyway", videoId, strings.Join(quality.Issues, ", "), quality.Score))
+		}
+		safeVideoDataCollection.Write(videoId, videoEntry)
+		return qualityActionIndex
+	}
+
+	if qp.action == qualityActionRetranscribe && !quality.Retranscribed {
+		slog.Warn(fmt.Sprintf("Transcript of %s has issues: %s (score %v), transcribing it again with the alternate settings", videoId, strings.Join(quality.Issues, ", "), quality.Score))
+		// the rejected transcript is kept for comparison. The transcribe
+		// step skips videos that already have a transcript
+		err = os.Rename(transcriptFilePath, filepath.Join(transcriptsPath, fmt.Sprintf("%s.rejected.srt", videoId)))
+		if err == nil {
+			quality.Retranscribed = true
+			// the speakers belong to the rejected transcript
+			os.Remove(speakersFilePath(transcriptsPath, videoId))
+			// the rejected transcript does not count as a version
+			videoEntry.TranscriptVersion = nil
+			videoEntry.Status = "processed"
+			safeVideoDataCollection.Write(videoId, videoEntry)
+			return qualityActionRetranscribe
+		}
+		slog.Error(fmt.Sprintf("Unable to move rejected transcript of %s: %s", videoId, err.Error()))
+	}
+
+	slog.Warn(fmt.Sprintf("Transcript of %s has issues: %s (score %v), quarantining it instead of indexing it", videoId, strings.Join(quality.Issues, ", "), quality.Score))
+	videoEntry.Status = "quarantined"
+	safeVideoDataCollection.Write(videoId, videoEntry)
+	return qualityActionQuarantine
+}
+
+// WhisperSettings returns the model and extra arguments to transcribe a
+// video with, which are the alternate settings once the transcript of the
+// video has been rejected
+func (qp *QualityPolicy) WhisperSettings(modelPath string, videoEntry VideoData) (string, []string) {
+	if videoEntry.Quality == nil || !videoEntry.Quality.Retranscribed {
+		return modelPath, nil
+	}
+	if qp.retranscribeModelPath != "" {
+		modelPath = qp.retranscribeModelPath
+	}
+	return modelPath, qp.retranscribeArgs
+}
+
+// normalizeCueText lowercases the text of a cue and removes punctuation so
+// that repeated lines are found regardless of how whisper punctuated them
+func normalizeCueText(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+func roundScore(score float64) float64 {
+	return math.Round(score*100) / 100
+}
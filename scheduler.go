@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+var queueOrders = map[string]bool{"newest": true, "oldest": true, "shortest": true}
+
+type scheduledVideo struct {
+	id    string
+	video VideoData
+}
+
+// stageQueue holds the videos waiting for a stage until a worker of the
+// stage is free to take the next one
+type stageQueue struct {
+	videos []scheduledVideo
+	// ready is signalled when a video is added
+	ready chan struct{}
+}
+
+// Scheduler orders the videos added to the queues instead of sending them in
+// the random order of the video data collection. Videos with a higher
+// priority always go first, then videos are ordered by QUEUE_ORDER
+type Scheduler struct {
+	order  string
+	queues map[string]*stageQueue
+	mu     sync.Mutex
+}
+
+func NewScheduler(order string) (*Scheduler, error) {
+	if order == "" {
+		order = "newest"
+	}
+	if !queueOrders[order] {
+		return nil, fmt.Errorf("unknown queue order %s, expected newest, oldest or shortest", order)
+	}
+	return &Scheduler{
+		order:  order,
+		queues: map[string]*stageQueue{},
+	}, nil
+}
+
+// Start sends the videos added to a stage to its queue one at a time, best
+// first, as the workers of the stage pick them up. Every stage has its own
+// queue so that videos already partway through the pipeline are never stuck
+// behind videos waiting to be downloaded
+func (s *Scheduler) Start(stage string, queue chan<- string) {
+	s.mu.Lock()
+	sq := &stageQueue{ready: make(chan struct{}, 1)}
+	s.queues[stage] = sq
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			id, ok := s.next(sq)
+			if !ok {
+				<-sq.ready
+				continue
+			}
+			queue <- id
+		}
+	}()
+}
+
+// Push adds videos to the queue of a stage. The stage has to be started
+// first. Videos are added together so that the first of them is not sent
+// before the rest are added
+func (s *Scheduler) Push(stage string, videos []scheduledVideo) {
+	s.mu.Lock()
+	sq := s.queues[stage]
+	sq.videos = append(sq.videos, videos...)
+	s.mu.Unlock()
+	queueDepth.WithLabelValues(stage).Add(float64(len(videos)))
+	select {
+	case sq.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next removes the best video from the queue. The queue is scanned on every
+// call which is fast enough for the few thousand videos of a channel
+func (s *Scheduler) next(sq *stageQueue) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(sq.videos) == 0 {
+		return "", false
+	}
+	best := 0
+	for i := 1; i < len(sq.videos); i++ {
+		if s.before(sq.videos[i], sq.videos[best]) {
+			best = i
+		}
+	}
+	id := sq.videos[best].id
+	sq.videos = append(sq.videos[:best], sq.videos[best+1:]...)
+	return id, true
+}
+
+// before reports whether a has to be sent before b. Videos with missing
+// upload dates or durations are sent last
+func (s *Scheduler) before(a scheduledVideo, b scheduledVideo) bool {
+	if a.video.Priority != b.video.Priority {
+		return a.video.Priority > b.video.Priority
+	}
+	switch s.order {
+	case "newest", "oldest":
+		aDate, bDate := a.video.UploadDate, b.video.UploadDate
+		if aDate != bDate {
+			if aDate == "NA" || aDate == "" {
+				return false
+			}
+			if bDate == "NA" || bDate == "" {
+				return true
+			}
+			// dates are YYYYMMDD so they sort as strings
+			if s.order == "newest" {
+				return aDate > bDate
+			}
+			return aDate < bDate
+		}
+	case "shortest":
+		aDuration, aErr := strconv.ParseFloat(a.video.Duration, 64)
+		bDuration, bErr := strconv.ParseFloat(b.video.Duration, 64)
+		if aErr != nil || bErr != nil {
+			if (aErr == nil) != (bErr == nil) {
+				return aErr == nil
+			}
+		} else if aDuration != bDuration {
+			return aDuration < bDuration
+		}
+	}
+	return a.id < b.id
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// maxMoments is the number of matching cues returned for each video
+const maxMoments = 5
+
+// maxSearchLimit is the most videos returned by a single search since each
+// hit includes all the cues of the video
+const maxSearchLimit = 100
+
+// SearchOptions are the query and filters of a search
+type SearchOptions struct {
+	Query string
+	// Channel matches the channel name or the url of the source
+	Channel string
+	// After and Before are upload dates as YYYYMMDD, both inclusive
+	After       string
+	Before      string
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	Limit       int64
+	Offset      int64
+	// SemanticRatio mixes in semantic search when embeddings are set up,
+	// from 0 for keyword search only to 1 for semantic search only
+	SemanticRatio float64
+}
+
+// searchParams are the names of the search options along with their usage,
+// used both as flags of the search command and as query parameters of the
+// search api
+var searchParams = []struct {
+	name  string
+	usage string
+}{
+	{"channel", "only videos of a channel, by the channel name or the url or directory of the source"},
+	{"after", "only videos uploaded on or after a date as YYYYMMDD or YYYY-MM-DD"},
+	{"before", "only videos uploaded on or before a date as YYYYMMDD or YYYY-MM-DD"},
+	{"min-duration", "only videos at least this long, such as 2m or 1h30m"},
+	{"max-duration", "only videos at most this long, such as 2m or 1h30m"},
+	{"limit", fmt.Sprintf("the number of videos to return, 10 by default and at most %v", maxSearchLimit)},
+	{"offset", "the number of videos to skip for the next page"},
+	{"semantic", "mix in semantic search from 0 for keyword search only to 1 for semantic search only"},
+}
+
+// parseSearchOptions reads the search options from flags or query parameters
+func parseSearchOptions(query string, get func(name string) string) (SearchOptions, error) {
+	options := SearchOptions{Query: query, Channel: get("channel"), Limit: 10}
+	var errs []error
+	var err error
+	options.After, err = parseFilterDate(get("after"))
+	errs = append(errs, err)
+	options.Before, err = parseFilterDate(get("before"))
+	errs = append(errs, err)
+	if value := get("min-duration"); value != "" {
+		options.MinDuration, err = time.ParseDuration(value)
+		errs = append(errs, err)
+	}
+	if value := get("max-duration"); value != "" {
+		options.MaxDuration, err = time.ParseDuration(value)
+		errs = append(errs, err)
+	}
+	if value := get("limit"); value != "" {
+		options.Limit, err = strconv.ParseInt(value, 10, 64)
+		errs = append(errs, err)
+		if err == nil && options.Limit < 1 {
+			errs = append(errs, errors.New("limit has to be at least 1"))
+		}
+		options.Limit = min(options.Limit, maxSearchLimit)
+	}
+	if value := get("offset"); value != "" {
+		options.Offset, err = strconv.ParseInt(value, 10, 64)
+		errs = append(errs, err)
+		if err == nil && options.Offset < 0 {
+			errs = append(errs, errors.New("offset cannot be negative"))
+		}
+	}
+	if value := get("semantic"); value != "" {
+		options.SemanticRatio, err = strconv.ParseFloat(value, 64)
+		errs = append(errs, err)
+		if err == nil && (options.SemanticRatio < 0 || options.SemanticRatio > 1) {
+			errs = append(errs, errors.New("semantic has to be between 0 and 1"))
+		}
+	}
+	return options, errors.Join(errs...)
+}
+
+// filter converts the filters of the search into a Meilisearch filter
+func (so SearchOptions) filter() string {
+	var filters []string
+	if so.Channel != "" {
+		filters = append(filters, fmt.Sprintf("(channel = %s OR source = %s)", strconv.Quote(so.Channel), strconv.Quote(so.Channel)))
+	}
+	if so.After != "" {
+		filters = append(filters, fmt.Sprintf("uploadDay >= %s", so.After))
+	}
+	if so.Before != "" {
+		filters = append(filters, fmt.Sprintf("uploadDay <= %s", so.Before))
+	}
+	if so.MinDuration > 0 {
+		filters = append(filters, fmt.Sprintf("durationSeconds >= %v", so.MinDuration.Seconds()))
+	}
+	if so.MaxDuration > 0 {
+		filters = append(filters, fmt.Sprintf("durationSeconds <= %v", so.MaxDuration.Seconds()))
+	}
+	return strings.Join(filters, " AND ")
+}
+
+// SearchResults are the videos that match a search
+type SearchResults struct {
+	Query              string      `json:"query"`
+	EstimatedTotalHits int64       `json:"estimatedTotalHits"`
+	Hits               []SearchHit `json:"hits"`
+}
+
+type SearchHit struct {
+	Id         string `json:"id"`
+	Title      string `json:"title"`
+	Url        string `json:"url"`
+	Channel    string `json:"channel,omitempty"`
+	UploadDate string `json:"uploadDate"`
+	Duration   string `json:"duration"`
+	// Snippet is the part of the transcript that matches with the matched
+	// words highlighted
+	Snippet string   `json:"snippet"`
+	Moments []Moment `json:"moments"`
+}
+
+// Moment is a cue of the transcript that matches the search, with a link to
+// the video at the time of the cue
+type Moment struct {
+	Start     float64 `json:"start"`
+	End       float64 `json:"end"`
+	Timestamp string  `json:"timestamp"`
+	Text      string  `json:"text"`
+	Url       string  `json:"url"`
+}
+
+// searchHit is a hit of the videos index as returned by Meilisearch
+type searchHit struct {
+	Document
+	Formatted struct {
+		Transcript string `json:"transcript"`
+	} `json:"_formatted"`
+	MatchesPosition struct {
+		Transcript []struct {
+			Start int `json:"start"`
+		} `json:"transcript"`
+	} `json:"_matchesPosition"`
+}
+
+// Searcher searches the videos index
+type Searcher struct {
+	searchClient     meilisearch.ServiceManager
+	vectorizer       *Vectorizer
+	highlightPreTag  string
+	highlightPostTag string
+}
+
+func NewSearcher(searchClient meilisearch.ServiceManager, vectorizer *Vectorizer, highlightPreTag string, highlightPostTag string) *Searcher {
+	return &Searcher{
+		searchClient:     searchClient,
+		vectorizer:       vectorizer,
+		highlightPreTag:  highlightPreTag,
+		highlightPostTag: highlightPostTag,
+	}
+}
+
+func (s *Searcher) Search(ctx context.Context, options SearchOptions) (SearchResults, error) {
+	request := &meilisearch.SearchRequest{
+		Limit:                 options.Limit,
+		Offset:                options.Offset,
+		AttributesToRetrieve:  []string{"id", "title", "url", "channel", "uploadDate", "duration", "transcript", "cues"},
+		AttributesToCrop:      []string{"transcript"},
+		CropLength:            30,
+		AttributesToHighlight: []string{"transcript"},
+		HighlightPreTag:       s.highlightPreTag,
+		HighlightPostTag:      s.highlightPostTag,
+		ShowMatchesPosition:   true,
+		Filter:                options.filter(),
+	}
+	if options.SemanticRatio > 0 {
+		hybrid, vector, err := s.vectorizer.Hybrid(ctx, options.Query, options.SemanticRatio)
+		if err != nil {
+			return SearchResults{}, err
+		}
+		request.Hybrid = hybrid
+		request.Vector = vector
+	}
+	response, err := s.searchClient.Index("videos").SearchWithContext(ctx, options.Query, request)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	results := SearchResults{Query: options.Query, EstimatedTotalHits: response.EstimatedTotalHits, Hits: []SearchHit{}}
+	for _, rawHit := range response.Hits {
+		// the hits are maps so they are decoded again into a struct
+		data, err := json.Marshal(rawHit)
+		if err != nil {
+			return SearchResults{}, err
+		}
+		var hit searchHit
+		err = json.Unmarshal(data, &hit)
+		if err != nil {
+			return SearchResults{}, err
+		}
+		results.Hits = append(results.Hits, SearchHit{
+			Id:         hit.Id,
+			Title:      hit.Title,
+			Url:        hit.Url,
+			Channel:    hit.Channel,
+			UploadDate: hit.UploadDate,
+			Duration:   hit.Duration,
+			Snippet:    hit.Formatted.Transcript,
+			Moments:    hit.moments(),
+		})
+	}
+	return results, nil
+}
+
+// moments finds the cues of the matches in the transcript. Semantic matches
+// have no positions so they have no moments
+func (h searchHit) moments() []Moment {
+	moments := []Moment{}
+	spoken := spokenCues(h.Cues)
+	seen := map[int]bool{}
+	for _, match := range h.MatchesPosition.Transcript {
+		i, offset, ok := cueAtOffset(spoken, match.Start)
+		if !ok || seen[i] {
+			continue
+		}
+		seen[i] = true
+		cue := spoken[i]
+		// the moment starts at the matched word when the words are known
+		start := cue.startAt(offset)
+		moments = append(moments, Moment{
+			Start:     start,
+			End:       cue.End,
+			Timestamp: formatTimestamp(start),
+			Text:      cue.Text,
+			Url:       timestampUrl(h.Url, start),
+		})
+		if len(moments) == maxMoments {
+			break
+		}
+	}
+	return moments
+}
+
+// formatTimestamp formats seconds as 1:02:03, or 2:03 for times under an
+// hour
+func formatTimestamp(seconds float64) string {
+	total := int(seconds)
+	if total >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", total/3600, total%3600/60, total%60)
+	}
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
+
+// timestampUrl links to a time in a video. YouTube takes the time as the t
+// parameter, other sites and audio files in browsers take it as a media
+// fragment
+func timestampUrl(videoUrl string, seconds float64) string {
+	u, err := url.Parse(videoUrl)
+	if err != nil || videoUrl == "" {
+		return videoUrl
+	}
+	switch strings.TrimPrefix(u.Hostname(), "www.") {
+	case "youtube.com", "m.youtube.com", "music.youtube.com", "youtu.be":
+		query := u.Query()
+		query.Del("t")
+		// the time goes last so that the video id stays first
+		u.RawQuery = strings.TrimPrefix(query.Encode()+fmt.Sprintf("&t=%ds", int(seconds)), "&")
+	default:
+		u.Fragment = fmt.Sprintf("t=%d", int(seconds))
+	}
+	return u.String()
+}
+
+// serveSearch serves the search api at /search
+func serveSearch(addr string, searcher *Searcher) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		options, err := parseSearchOptions(r.URL.Query().Get("q"), r.URL.Query().Get)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		results, err := searcher.Search(r.Context(), options)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Unable to search: %s", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(results)
+	})
+	// the timeouts keep slow or idle clients from holding connections open,
+	// the write timeout leaves time for semantic searches to embed the query
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	slog.Info(fmt.Sprintf("Serving search on %s/search", addr))
+	return server.ListenAndServe()
+}
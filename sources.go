@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Source is where videos are gathered from
+type Source struct {
+	// Type is youtube for YouTube channels, url for any other page that
+	// yt-dlp supports such as Vimeo channels or Twitch VODs, podcast for
+	// podcast RSS feeds and local for a directory of audio and video files
+	Type string
+	// Url is the directory of the files for local sources
+	Url string
+	// Schedule is only used in watch mode
+	Schedule cron.Schedule
+	// UseFeed checks the channel feed for recent uploads instead of listing
+	// every video of the channel, except once every FullScanInterval
+	UseFeed          bool
+	FullScanInterval time.Duration
+	// Filter is applied to new videos once their details are fetched
+	Filter *VideoFilter
+}
+
+// VideoRef is a video that has been found in a source along with the url
+// its details are fetched from
+type VideoRef struct {
+	Id  string
+	Url string
+}
+
+func youtubeVideoUrl(videoId string) string {
+	return "https://www.youtube.com/watch?v=" + videoId
+}
+
+// videoUrl returns the url the video is downloaded from. Videos saved before
+// urls were recorded are all YouTube videos
+func videoUrl(videoEntry VideoData) string {
+	if videoEntry.Url != "" {
+		return videoEntry.Url
+	}
+	return youtubeVideoUrl(videoEntry.Id)
+}
+
+// localFilePath returns the path of the file for videos from local sources
+func localFilePath(url string) (string, bool) {
+	return strings.CutPrefix(url, "file://")
+}
+
+// meilisearch document ids can only contain alphanumeric characters, - and _
+var invalidIdCharsRegex = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// makeVideoId prefixes the id with the site the video is from so that ids
+// from different sites do not collide
+func makeVideoId(prefix string, id string) string {
+	return strings.ToLower(prefix) + "-" + invalidIdCharsRegex.ReplaceAllString(id, "_")
+}
+
+// makeHashedVideoId makes the id from a hash of the key for videos whose
+// ids are paths or urls, which can collide once invalid characters are
+// replaced and can be longer than Meilisearch allows for document ids
+func makeHashedVideoId(prefix string, key string) string {
+	hash := sha1.Sum([]byte(key))
+	return makeVideoId(prefix, hex.EncodeToString(hash[:8]))
+}
+
+// addVideosToQueue fetches the details of the videos found in a source and
+// adds them to the queue
+func addVideosToQueue(ctx context.Context, videoRefs []VideoRef, source Source, isUpdate bool, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) {
+	if isUpdate {
+		slog.Info("video details/metadata of all videos already in queue will be refetched and reindexed")
+		addAndUpdateVideosInQueue(ctx, videoRefs, source, safeVideoDataCollection, maxWorkers, stagePolicy)
+	} else {
+		addNewVideosToQueue(ctx, videoRefs, source, safeVideoDataCollection, maxWorkers, stagePolicy)
+	}
+}
+
+type ytdlpFlatEntry struct {
+	Id           string `json:"id"`
+	ExtractorKey string `json:"extractor_key"`
+	IeKey        string `json:"ie_key"`
+	WebpageUrl   string `json:"webpage_url"`
+	Url          string `json:"url"`
+}
+
+// gatherUrlVideos adds the videos of any url supported by yt-dlp to the queue
+func gatherUrlVideos(ctx context.Context, source Source, isUpdate bool, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) error {
+	slog.Info(fmt.Sprintf("Checking %s for new videos", source.Url))
+	videoRefs, err := listUrlVideos(ctx, source.Url, stagePolicy)
+	if err != nil {
+		return err
+	}
+	addVideosToQueue(ctx, videoRefs, source, isUpdate, safeVideoDataCollection, maxWorkers, stagePolicy)
+	return nil
+}
+
+// listUrlVideos lists the videos of any url supported by yt-dlp. The url can
+// be a single video or a playlist, channel or feed of videos
+func listUrlVideos(ctx context.Context, url string, stagePolicy *StagePolicy) ([]VideoRef, error) {
+	ctx, cancel := stagePolicy.Context(ctx, "gather", "")
+	defer cancel()
+	// entries of playlists only have url and ie_key while single videos
+	// have webpage_url and extractor_key
+	cmdFetch := newCommand(ctx, "yt-dlp", "--flat-playlist", "--print", "%(.{id,extractor_key,ie_key,webpage_url,url})j", url)
+	out, err := cmdFetch.Output()
+	if err != nil {
+		return nil, errors.New(err.Error() + string(out))
+	}
+
+	var videoRefs []VideoRef
+	decoder := json.NewDecoder(strings.NewReader(string(out)))
+	for {
+		var entry ytdlpFlatEntry
+		err = decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		extractor := entry.ExtractorKey
+		if extractor == "" {
+			extractor = entry.IeKey
+		}
+		url := entry.WebpageUrl
+		if url == "" {
+			url = entry.Url
+		}
+		if entry.Id == "" || url == "" {
+			continue
+		}
+		// YouTube videos keep their id so that they are not added twice
+		// when they are also in a YouTube channel source
+		if extractor == "Youtube" {
+			videoRefs = append(videoRefs, VideoRef{Id: entry.Id, Url: youtubeVideoUrl(entry.Id)})
+			continue
+		}
+		videoRefs = append(videoRefs, VideoRef{Id: makeVideoId(extractor, entry.Id), Url: url})
+	}
+	return videoRefs, nil
+}
+
+var mediaExtensions = map[string]bool{
+	".mp3": true, ".m4a": true, ".aac": true, ".wav": true, ".flac": true, ".ogg": true, ".opus": true,
+	".mp4": true, ".mkv": true, ".webm": true, ".mov": true, ".avi": true,
+}
+
+// gatherLocalVideos adds the audio and video files in the directory of the
+// source and its subdirectories to the queue
+func gatherLocalVideos(ctx context.Context, source Source, isUpdate bool, safeVideoDataCollection *SafeVideoDataCollection, maxWorkers int, stagePolicy *StagePolicy) error {
+	slog.Info(fmt.Sprintf("Checking %s for new files", source.Url))
+	videoRefs, err := listLocalVideos(source.Url)
+	if err != nil {
+		return err
+	}
+	addVideosToQueue(ctx, videoRefs, source, isUpdate, safeVideoDataCollection, maxWorkers, stagePolicy)
+	return nil
+}
+
+// listLocalVideos lists the audio and video files in a directory and its
+// subdirectories, or a single file. The id of each file is derived from its
+// path so the same file keeps its id across runs
+func listLocalVideos(dirOrFile string) ([]VideoRef, error) {
+	dir, err := filepath.Abs(dirOrFile)
+	if err != nil {
+		return nil, err
+	}
+	var videoRefs []VideoRef
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !mediaExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		videoRefs = append(videoRefs, VideoRef{
+			Id:  makeHashedVideoId("local", path),
+			Url: "file://" + path,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return videoRefs, nil
+}
+
+type ffprobeOutput struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+	Chapters []struct {
+		StartTime string            `json:"start_time"`
+		EndTime   string            `json:"end_time"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"chapters"`
+}
+
+// probeLocalFile gets the details of a local file from its tags with ffprobe.
+// The file name and modification time are used when the file has no tags
+func probeLocalFile(ctx context.Context, videoRef VideoRef, stagePolicy *StagePolicy) (VideoMetadata, error) {
+	path, _ := localFilePath(videoRef.Url)
+	ctx, cancel := stagePolicy.Context(ctx, "metadata", "")
+	defer cancel()
+	cmdProbe := newCommand(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_chapters", path)
+	out, err := cmdProbe.Output()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Unable to get metadata for %s: %s", path, err.Error()))
+		return VideoMetadata{}, err
+	}
+	var probe ffprobeOutput
+	err = json.Unmarshal(out, &probe)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Unable to parse metadata for %s: %s", path, err.Error()))
+		return VideoMetadata{}, err
+	}
+	// tag names are upper case in some containers
+	tags := map[string]string{}
+	for key, value := range probe.Format.Tags {
+		tags[strings.ToLower(key)] = value
+	}
+
+	metadata := VideoMetadata{
+		VideoDetails: VideoDetails{
+			Id:         videoRef.Id,
+			Url:        videoRef.Url,
+			Title:      tags["title"],
+			UploadDate: "NA",
+			Duration:   "NA",
+		},
+	}
+	if metadata.Title == "" {
+		metadata.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	seconds, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err == nil {
+		metadata.Duration = strconv.FormatFloat(seconds, 'f', 0, 64)
+	}
+	creationTime, err := time.Parse(time.RFC3339, tags["creation_time"])
+	if err == nil {
+		metadata.UploadDate = creationTime.Format("20060102")
+	} else if info, err := os.Stat(path); err == nil {
+		metadata.UploadDate = info.ModTime().Format("20060102")
+	}
+	// podcasts and audiobooks often have chapters in their tags
+	for _, chapter := range probe.Chapters {
+		start, startErr := strconv.ParseFloat(chapter.StartTime, 64)
+		end, endErr := strconv.ParseFloat(chapter.EndTime, 64)
+		if startErr != nil || endErr != nil {
+			continue
+		}
+		metadata.Chapters = append(metadata.Chapters, Chapter{Title: chapter.Tags["title"], Start: start, End: end})
+	}
+	return metadata, nil
+}
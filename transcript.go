@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Cue is a single subtitle of a transcript. Start and End are in seconds
+// from the start of the video
+type Cue struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+	// Speaker is only set when diarization is enabled
+	Speaker string `json:"speaker,omitempty"`
+	// Words are only available when the json transcript is written
+	Words []Word `json:"words,omitempty"`
+}
+
+// srtTimingPattern matches the timing line of a cue such as
+// 00:00:01,000 --> 00:00:04,500
+var srtTimingPattern = regexp.MustCompile(`^(\d+):(\d{2}):(\d{2})[,.](\d{3})\s*-->\s*(\d+):(\d{2}):(\d{2})[,.](\d{3})`)
+
+// annotationPattern matches cues such as [BLANK_AUDIO] or (music) that
+// whisper emits for sections without speech
+var annotationPattern = regexp.MustCompile(`^\s*[\[(][^\])]*[\])]\s*$`)
+
+// parseSrt reads the cues of an srt file. The cue numbers are ignored since
+// they only number the cues in order
+func parseSrt(srt string) ([]Cue, error) {
+	var cues []Cue
+	var cue *Cue
+	var text []string
+	endCue := func() {
+		if cue != nil {
+			cue.Text = strings.Join(strings.Fields(strings.Join(text, " ")), " ")
+			cues = append(cues, *cue)
+		}
+		cue = nil
+		text = nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(strings.TrimPrefix(srt, "\ufeff")))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			endCue()
+			continue
+		}
+		if match := srtTimingPattern.FindStringSubmatch(line); match != nil {
+			// a cue without a blank line before the next timing line
+			endCue()
+			cue = &Cue{
+				Start: srtSeconds(match[1:5]),
+				End:   srtSeconds(match[5:9]),
+			}
+			continue
+		}
+		if cue == nil {
+			// the cue number before the timing line
+			if _, err := strconv.Atoi(line); err == nil {
+				continue
+			}
+			return nil, fmt.Errorf("line %v: expected a cue number or timing, got %q", lineNumber, line)
+		}
+		text = append(text, line)
+	}
+	endCue()
+	return cues, scanner.Err()
+}
+
+// srtSeconds converts the hours, minutes, seconds and milliseconds of an srt
+// timestamp to seconds
+func srtSeconds(parts []string) float64 {
+	var values [4]int
+	for i, part := range parts {
+		values[i], _ = strconv.Atoi(part)
+	}
+	return float64(values[0]*3600+values[1]*60+values[2]) + float64(values[3])/1000
+}
+
+// spokenCues leaves out the cues that only mark sections without speech
+func spokenCues(cues []Cue) []Cue {
+	var spoken []Cue
+	for _, cue := range cues {
+		if cue.Text == "" || annotationPattern.MatchString(cue.Text) {
+			continue
+		}
+		spoken = append(spoken, cue)
+	}
+	return spoken
+}
+
+// transcriptText merges the spoken cues into the plain text that is
+// searched. The cues are separated by a space, which cueAtOffset relies on
+func transcriptText(cues []Cue) string {
+	var texts []string
+	for _, cue := range spokenCues(cues) {
+		texts = append(texts, cue.Text)
+	}
+	return strings.Join(texts, " ")
+}
+
+// cueAtOffset returns the index in the spoken cues of the cue that the byte
+// offset of the transcript text falls in, along with the offset in the text
+// of the cue
+func cueAtOffset(spoken []Cue, offset int) (int, int, bool) {
+	var start int
+	for i, cue := range spoken {
+		end := start + len(cue.Text)
+		if offset >= start && offset < end {
+			return i, offset - start, true
+		}
+		// the space after the cue
+		start = end + 1
+	}
+	return 0, 0, false
+}
+
+// startAt returns the time the word at the byte offset of the text of the
+// cue was spoken. The start of the cue is used when its words are not known
+// or do not line up with its text
+func (c Cue) startAt(offset int) float64 {
+	if len(c.Words) == 0 || len(strings.Fields(c.Text)) != len(c.Words) || offset >= len(c.Text) {
+		return c.Start
+	}
+	i := max(len(strings.Fields(c.Text[:offset+1]))-1, 0)
+	return c.Words[i].Start
+}
+
+// readTranscript reads the srt transcript of a video and returns its plain
+// text along with its cues
+func readTranscript(transcriptFilePath string) (string, []Cue, error) {
+	srt, err := os.ReadFile(transcriptFilePath)
+	if err != nil {
+		return "", nil, err
+	}
+	cues, err := parseSrt(string(srt))
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to parse %s: %s", transcriptFilePath, err.Error())
+	}
+	return transcriptText(cues), cues, nil
+}
+
+// TranscriptVersion records how a transcript was made so that videos can be
+// transcribed again when a better model is available
+type TranscriptVersion struct {
+	Version int `json:"version"`
+	// Model is the file name of the whisper model, unknown for transcripts
+	// made before models were recorded
+	Model string `json:"model"`
+	// Args are the extra arguments whisper-cli was run with
+	Args          []string `json:"args,omitempty"`
+	TranscribedAt string   `json:"transcribedAt,omitempty"`
+}
+
+// nextTranscriptVersion returns the version number of the next transcript
+// of a video
+func nextTranscriptVersion(videoEntry VideoData) int {
+	version := 0
+	if videoEntry.TranscriptVersion != nil {
+		version = videoEntry.TranscriptVersion.Version
+	}
+	for _, previous := range videoEntry.PreviousTranscriptVersions {
+		version = max(version, previous.Version)
+	}
+	return version + 1
+}
+
+// versionFilePath returns the path a transcript file of a previous version
+// is kept at
+func versionFilePath(transcriptsPath string, videoId string, version int, ext string) string {
+	return filepath.Join(transcriptsPath, "versions", fmt.Sprintf("%s.v%v%s", videoId, version, ext))
+}
+
+// archiveTranscript moves the transcript files of a video to the versions
+// directory so that the video is transcribed again. Only the newest keep
+// previous versions are kept, 0 keeps all of them
+func archiveTranscript(transcriptsPath string, videoId string, videoEntry *VideoData, keep int) error {
+	if !fileExists(filepath.Join(transcriptsPath, videoId+".srt")) {
+		return nil
+	}
+	version := videoEntry.TranscriptVersion
+	if version == nil {
+		version = &TranscriptVersion{Version: nextTranscriptVersion(*videoEntry), Model: "unknown"}
+	}
+	err := os.MkdirAll(filepath.Join(transcriptsPath, "versions"), 0755)
+	if err != nil {
+		return err
+	}
+	for _, ext := range transcriptExtensions {
+		filePath := filepath.Join(transcriptsPath, videoId+ext)
+		if !fileExists(filePath) {
+			continue
+		}
+		err = os.Rename(filePath, versionFilePath(transcriptsPath, videoId, version.Version, ext))
+		if err != nil {
+			return err
+		}
+	}
+	videoEntry.PreviousTranscriptVersions = append(videoEntry.PreviousTranscriptVersions, *version)
+	videoEntry.TranscriptVersion = nil
+
+	for keep > 0 && len(videoEntry.PreviousTranscriptVersions) > keep {
+		oldest := videoEntry.PreviousTranscriptVersions[0]
+		for _, ext := range transcriptExtensions {
+			os.Remove(versionFilePath(transcriptsPath, videoId, oldest.Version, ext))
+		}
+		videoEntry.PreviousTranscriptVersions = videoEntry.PreviousTranscriptVersions[1:]
+	}
+	return nil
+}
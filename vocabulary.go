@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Vocabulary helps whisper with the names and jargon of a source, first by
+// giving whisper a prompt with the words it should expect and then by
+// correcting the words it still gets wrong before the transcript is indexed
+type Vocabulary struct {
+	entries []vocabularyEntry
+}
+
+type vocabularyEntry struct {
+	// source is the url or directory of the source the entry applies to,
+	// all sources when empty
+	source       string
+	prompt       string
+	replacements []replacement
+}
+
+type replacement struct {
+	find    string
+	replace string
+	pattern *regexp.Regexp
+}
+
+// Correction records a replacement that was made in the transcript of a
+// video
+type Correction struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+	Count   int    `json:"count"`
+}
+
+func NewVocabulary(configs []VocabularyConfig) (*Vocabulary, error) {
+	var vocabulary Vocabulary
+	for i, config := range configs {
+		entry := vocabularyEntry{source: config.Source, prompt: config.Prompt}
+		for j, replacementConfig := range config.Replacements {
+			if replacementConfig.Find == "" {
+				return nil, fmt.Errorf("vocabulary[%v].replacements[%v].find is not set", i, j)
+			}
+			pattern, err := compileReplacement(replacementConfig)
+			if err != nil {
+				return nil, fmt.Errorf("vocabulary[%v].replacements[%v].find is invalid: %s", i, j, err.Error())
+			}
+			entry.replacements = append(entry.replacements, replacement{
+				find:    replacementConfig.Find,
+				replace: replacementConfig.Replace,
+				pattern: pattern,
+			})
+		}
+		vocabulary.entries = append(vocabulary.entries, entry)
+	}
+	return &vocabulary, nil
+}
+
+// compileReplacement compiles the text to find into a regular expression.
+// Plain text only matches whole words so that short words are not replaced
+// inside longer ones
+func compileReplacement(config ReplacementConfig) (*regexp.Regexp, error) {
+	expression := config.Find
+	if !config.Regex {
+		expression = regexp.QuoteMeta(config.Find)
+		first, _ := utf8.DecodeRuneInString(config.Find)
+		if isWordRune(first) {
+			expression = `\b` + expression
+		}
+		last, _ := utf8.DecodeLastRuneInString(config.Find)
+		if isWordRune(last) {
+			expression += `\b`
+		}
+	}
+	if !config.CaseSensitive {
+		expression = "(?i)" + expression
+	}
+	return regexp.Compile(expression)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (e vocabularyEntry) appliesTo(source string) bool {
+	return e.source == "" || e.source == source
+}
+
+// Prompt returns the prompt for videos of a source. The prompt of the
+// source is used over the prompt for all sources
+func (v *Vocabulary) Prompt(source string) string {
+	var prompt string
+	for _, entry := range v.entries {
+		if entry.prompt == "" || !entry.appliesTo(source) {
+			continue
+		}
+		if prompt == "" || entry.source != "" {
+			prompt = entry.prompt
+		}
+	}
+	return prompt
+}
+
+// Apply makes the replacements for a source in the text and words of the
+// cues and returns the corrections that were made. The replacements for all
+// sources are made first, then those of the source, each in the order they
+// are listed
+func (v *Vocabulary) Apply(source string, cues []Cue) []Correction {
+	var corrections []Correction
+	for _, sourceOnly := range []bool{false, true} {
+		for _, entry := range v.entries {
+			if (entry.source != "") != sourceOnly || !entry.appliesTo(source) {
+				continue
+			}
+			for _, replacement := range entry.replacements {
+				var count int
+				for i := range cues {
+					count += len(replacement.pattern.FindAllStringIndex(cues[i].Text, -1))
+					cues[i].Text = replacement.pattern.ReplaceAllString(cues[i].Text, replacement.replace)
+					cues[i].Words = replacement.applyToWords(cues[i].Words)
+				}
+				if count > 0 {
+					corrections = append(corrections, Correction{Find: replacement.find, Replace: replacement.replace, Count: count})
+				}
+			}
+		}
+	}
+	return corrections
+}
+
+// applyToWords makes the replacement in the words of a cue so that they keep
+// matching its text. The words a match spans are merged and replaced by the
+// words of the corrected text, which all take the start of the first and the
+// end of the last word that was merged
+func (r replacement) applyToWords(words []Word) []Word {
+	if len(words) == 0 {
+		return words
+	}
+	// the words are joined the same way whisper joins them into the text
+	texts := make([]string, len(words))
+	starts := make([]int, len(words))
+	ends := make([]int, len(words))
+	var offset int
+	for i, word := range words {
+		texts[i] = word.Text
+		starts[i] = offset
+		ends[i] = offset + len(word.Text)
+		offset = ends[i] + 1
+	}
+	text := strings.Join(texts, " ")
+	matches := r.pattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return words
+	}
+
+	corrected := make([]Word, 0, len(words))
+	var i int
+	for m := 0; m < len(matches) && i < len(words); {
+		if ends[i] <= matches[m][0] {
+			corrected = append(corrected, words[i])
+			i++
+			continue
+		}
+		// the words from first to last are merged until no more matches
+		// start inside them
+		first, last := i, i
+		from := min(starts[first], matches[m][0])
+		var merged []byte
+		for m < len(matches) && matches[m][0] < ends[last] {
+			merged = append(merged, text[from:matches[m][0]]...)
+			merged = r.pattern.ExpandString(merged, r.replace, text, matches[m])
+			from = matches[m][1]
+			for last+1 < len(words) && starts[last+1] < from {
+				last++
+			}
+			m++
+		}
+		if from < ends[last] {
+			merged = append(merged, text[from:ends[last]]...)
+		}
+		for _, field := range strings.Fields(string(merged)) {
+			corrected = append(corrected, Word{Text: field, Start: words[first].Start, End: words[last].End})
+		}
+		i = last + 1
+	}
+	return append(corrected, words[i:]...)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// parseSchedule accepts either an interval such as 30m or 1h, or a
+// standard 5 field cron expression such as "0 * * * *"
+func parseSchedule(expr string) (cron.Schedule, error) {
+	interval, err := time.ParseDuration(expr)
+	if err == nil {
+		if interval < time.Minute {
+			return nil, fmt.Errorf("interval has to be at least 1m: %s", expr)
+		}
+		return cron.Every(interval), nil
+	}
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid interval or cron expression: %s", expr)
+	}
+	return schedule, nil
+}
+
+// watchSources gathers videos from each source whenever the schedule of the
+// source is due and calls onGathered after each gather so that the new videos
+// can be fed to the workers. Each source has its own entry in the cron
+// scheduler but only one source is gathered at a time, and a source whose
+// schedule is due while it is still being gathered is skipped. It runs until
+// the context is cancelled
+func watchSources(ctx context.Context, sources []Source, gather func(Source) error, onGathered func()) {
+	scheduler := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)))
+	var mu sync.Mutex
+	sourceUrls := map[cron.EntryID]string{}
+	for _, source := range sources {
+		var id cron.EntryID
+		id = scheduler.Schedule(source.Schedule, cron.FuncJob(func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			err := gather(source)
+			if err != nil {
+				slog.Warn(fmt.Sprintf("Unable to gather videos from %s: %v", source.Url, err.Error()))
+			}
+			onGathered()
+			slog.Info(fmt.Sprintf("Next check of %s at %s", source.Url, scheduler.Entry(id).Next.Format(time.DateTime)))
+		}))
+		sourceUrls[id] = source.Url
+	}
+	scheduler.Start()
+	for _, entry := range scheduler.Entries() {
+		slog.Info(fmt.Sprintf("Next check of %s at %s", sourceUrls[entry.ID], entry.Next.Format(time.DateTime)))
+	}
+
+	<-ctx.Done()
+	// wait for a gather that is running to stop
+	<-scheduler.Stop().Done()
+}
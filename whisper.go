@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// transcriptFormats are the outputs that can be written by whisper-cli
+// along with the srt transcript, which is always written
+var transcriptFormats = map[string]string{
+	"vtt": "-ovtt",
+	"txt": "-otxt",
+	// the full json has the timestamps of every token
+	"json": "-ojf",
+}
+
+// transcriptExtensions are the extensions of all the transcript files of a
+// video
+var transcriptExtensions = []string{".srt", ".vtt", ".txt", ".json", ".speakers.json"}
+
+// Whisper holds the settings whisper-cli is run with
+type Whisper struct {
+	modelPath     string
+	outputFormats []string
+	qualityPolicy *QualityPolicy
+	vocabulary    *Vocabulary
+	// diarization is the way speakers are told apart, off when empty
+	diarization     string
+	diarizerCommand []string
+}
+
+func NewWhisper(config TranscriberConfig, qualityPolicy *QualityPolicy, vocabulary *Vocabulary) *Whisper {
+	return &Whisper{
+		modelPath:       config.ModelPath,
+		outputFormats:   config.OutputFormats,
+		qualityPolicy:   qualityPolicy,
+		vocabulary:      vocabulary,
+		diarization:     config.Diarization,
+		diarizerCommand: config.DiarizerCommand,
+	}
+}
+
+// settings returns the model and the extra arguments to transcribe a video
+// with
+func (w *Whisper) settings(videoEntry VideoData) (string, []string) {
+	modelPath, extraArgs := w.qualityPolicy.WhisperSettings(w.modelPath, videoEntry)
+	prompt := w.vocabulary.Prompt(videoEntry.Source)
+	if prompt != "" {
+		extraArgs = append([]string{"--prompt", prompt}, extraArgs...)
+	}
+	if w.diarization == diarizationTinydiarize {
+		extraArgs = append(extraArgs, "-tdrz")
+	}
+	return modelPath, extraArgs
+}
+
+// Args returns the arguments to transcribe a video with. The input file is
+// - when the audio is streamed to whisper-cli. The outputs are written to
+// the output file path followed by the extension of each format
+func (w *Whisper) Args(videoEntry VideoData, inputFilePath string, outputFilePath string) []string {
+	modelPath, extraArgs := w.settings(videoEntry)
+	args := []string{"--print-progress", "-osrt"}
+	for _, format := range w.outputFormats {
+		args = append(args, transcriptFormats[format])
+	}
+	// the speaker turns of tinydiarize are only written to the json output
+	if w.diarization == diarizationTinydiarize && !slices.Contains(w.outputFormats, "json") {
+		args = append(args, "-oj")
+	}
+	args = append(args, "-m", modelPath, "-f", inputFilePath, "-of", outputFilePath)
+	return append(args, extraArgs...)
+}
+
+// Version returns the version of a transcript made with the settings a
+// video is transcribed with
+func (w *Whisper) Version(videoEntry VideoData) *TranscriptVersion {
+	modelPath, extraArgs := w.settings(videoEntry)
+	return &TranscriptVersion{
+		Version:       nextTranscriptVersion(videoEntry),
+		Model:         filepath.Base(modelPath),
+		Args:          extraArgs,
+		TranscribedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// Word is a single word of a transcript. Start and End are in seconds from
+// the start of the video
+type Word struct {
+	Text  string  `json:"text"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// whisperTranscript is the json output of whisper-cli. Only the full json
+// has the tokens
+type whisperTranscript struct {
+	Transcription []struct {
+		Offsets struct {
+			From int `json:"from"`
+			To   int `json:"to"`
+		} `json:"offsets"`
+		// SpeakerTurnNext is set by tinydiarize when the next segment is
+		// spoken by another speaker
+		SpeakerTurnNext bool `json:"speaker_turn_next"`
+		Tokens          []struct {
+			Text    string `json:"text"`
+			Offsets struct {
+				From int `json:"from"`
+				To   int `json:"to"`
+			} `json:"offsets"`
+		} `json:"tokens"`
+	} `json:"transcription"`
+}
+
+// readWords reads the words of a transcript from the full json output of
+// whisper-cli. whisper splits text into tokens which are often parts of
+// words, so tokens are joined into words at the spaces that start them
+func readWords(jsonFilePath string) ([]Word, error) {
+	data, err := os.ReadFile(jsonFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var transcript whisperTranscript
+	err = json.Unmarshal(data, &transcript)
+	if err != nil {
+		return nil, err
+	}
+	var words []Word
+	for _, segment := range transcript.Transcription {
+		for _, token := range segment.Tokens {
+			// special tokens such as [_BEG_] and [_TT_150] are not text
+			if strings.HasPrefix(token.Text, "[_") {
+				continue
+			}
+			start := float64(token.Offsets.From) / 1000
+			end := float64(token.Offsets.To) / 1000
+			if len(words) == 0 || strings.HasPrefix(token.Text, " ") {
+				text := strings.TrimSpace(token.Text)
+				if text != "" {
+					words = append(words, Word{Text: text, Start: start, End: end})
+				}
+				continue
+			}
+			words[len(words)-1].Text += token.Text
+			words[len(words)-1].End = end
+		}
+	}
+	return words, nil
+}
+
+// addWords adds each word to the cue it was spoken in. Both are in the
+// order they were spoken
+func addWords(cues []Cue, words []Word) {
+	i := 0
+	for _, word := range words {
+		for i < len(cues)-1 && word.Start >= cues[i+1].Start {
+			i++
+		}
+		if i < len(cues) {
+			cues[i].Words = append(cues[i].Words, word)
+		}
+	}
+}